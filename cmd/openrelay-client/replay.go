@@ -18,21 +18,27 @@ package relay
 import (
 	"bufio"
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/zeromq/goczmq"
 	"io"
 	"log"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type replay struct {
-	Tick  int64
-	Frame []byte
+	Tick     int64
+	Header   defs.Header
+	DestUids []defs.PlayerId
+	Content  []byte
 }
 
 type client struct {
@@ -92,11 +98,16 @@ func main() {
 	defer replayFile.Close()
 	scanner := bufio.NewScanner(replayFile)
 	for scanner.Scan() {
-		rep := replay{}
-		line := strings.Split(scanner.Text(), ",")
-		rep.Tick = 0
-		//TODO rep.Frame = load byte load byte from hex string
-		//rep.Frame = strings.Split(line[2], ",")
+		// recorded line is tick, abloop, relay code, hex frame separated by tab.
+		line := strings.Split(scanner.Text(), "\t")
+		if len(line) < 4 {
+			continue
+		}
+		rep, err := loadReplay(line)
+		if err != nil {
+			fmt.Println("load failed. ", err)
+			continue
+		}
 		if line[1] == "A" {
 			replaysA = append(replaysA, rep)
 		} else if line[1] == "B" {
@@ -125,24 +136,39 @@ func main() {
 	os.Exit(0)
 }
 
+func loadReplay(line []string) (replay, error) {
+	rep := replay{}
+	tick, err := strconv.ParseInt(line[0], 10, 64)
+	if err != nil {
+		return rep, err
+	}
+	frame, err := hex.DecodeString(line[3])
+	if err != nil {
+		return rep, err
+	}
+	rep.Tick = tick
+	rep.Header, rep.DestUids, rep.Content, err = codec.DecodeFrame(frame)
+	return rep, err
+}
+
+func replayFrame(rep replay, uid int) ([]byte, error) {
+	header := rep.Header
+	header.SrcUid = defs.PlayerId(uid)
+	return codec.EncodeFrame(header, rep.DestUids, &codec.Raw{Data: rep.Content})
+}
+
 func GetNextAFrame(index int, uid int) ([]byte, error) {
 	if len(replaysA)-1 < index {
 		return []byte{}, errors.New("out of index")
 	}
-	//rep := replaysA[index]
-	var msg []byte
-	//msg := rep.Frame[0] + "," + rep.Frame[1] + "," + rep.Frame[2] + "," + rep.Frame[3] + "," + rep.Frame[4] + "," + rep.Frame[5] + "," + rep.Frame[6] + "," + rep.Frame[7] + "," + strconv.Itoa(uid) + "," + rep.Frame[9] + "," + rep.Frame[10] + "," + rep.Frame[11]
-	return []byte(msg), nil
+	return replayFrame(replaysA[index], uid)
 }
 
 func GetNextBFrame(index int, uid int) ([]byte, error) {
 	if len(replaysB)-1 < index {
 		return []byte{}, errors.New("out of index")
 	}
-	//rep := replaysB[index]
-	var msg []byte
-	//msg := rep.Frame[0] + "," + rep.Frame[1] + "," + rep.Frame[2] + "," + rep.Frame[3] + "," + rep.Frame[4] + "," + rep.Frame[5] + "," + rep.Frame[6] + "," + rep.Frame[7] + "," + strconv.Itoa(uid) + "," + rep.Frame[9] + "," + rep.Frame[10] + "," + rep.Frame[11]
-	return []byte(msg), nil
+	return replayFrame(replaysB[index], uid)
 }
 
 func Send(cli *client) {
@@ -155,7 +181,12 @@ func Send(cli *client) {
 	var frame []byte
 	var isABloop = false
 
-	cli.Deal.SendFrame([]byte("0,0,0,0,0,0,0,0-,1,16,0,"+createUUID()), goczmq.FlagNone)
+	header := defs.Header{Ver: defs.FrameVersion, RelayCode: defs.REPLAY_JOIN, DestCode: defs.ALL}
+	frame, err = codec.EncodeFrame(header, nil, &codec.Seed{Seed: []byte(createUUID())})
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Deal.SendFrame(frame, goczmq.FlagNone)
 	time.Sleep(time.Duration(3) * time.Second)
 
 	for {
@@ -178,7 +209,7 @@ func Send(cli *client) {
 			log.Fatal(err)
 		}
 		if logLevel > 0 {
-			log.Printf("<- %s\n", string(frame))
+			log.Printf("<- %s\n", hex.EncodeToString(frame))
 			log.Printf("# id:%d A:%d B:%d\n", cli.Id, cli.PosA, cli.PosB)
 		}
 		time.Sleep(time.Duration(100) * time.Millisecond)
@@ -17,8 +17,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"openrelay/internal/defs"
 	"openrelay/internal/srvs"
 )
 
@@ -29,7 +31,23 @@ var (
 	logLevel     int
 	logDir       string
 	hbTimeout    int
+	rejoinGrace  int
 	joinTimeout  int
+	stackMax     int
+	streamMax    int
+	contentMax   int
+	historyMax   int
+	propMax      int
+	propValueMax int
+	minFrameVer  int
+	compress     int
+	compressMin  int
+	authenticate bool
+	sessionTtl   int
+	sessionMax   int
+	rateLimit    string
+	kickStrikes  int
+	playerDir    string
 	listenMode   int
 	listenIpv4   string
 	listenIpv6   string
@@ -50,6 +68,8 @@ var (
 	stlSubProto  string
 	stlSubHost   string
 	stlSubPorts  string
+	transports   string
+	wsOrigins    string
 )
 
 func param() {
@@ -59,8 +79,24 @@ func param() {
 	flag.IntVar(&logLevel, "log", 0, "loglevel ... 0=fatalonly, 1=erroronly 2=info, 3=verbose, 4=veryverbose")
 	flag.StringVar(&logDir, "logdir", "/var/log/openrelay", "base log directory")
 	flag.IntVar(&hbTimeout, "hbtimeout", 30, "heatbeat timeout sec")
+	flag.IntVar(&rejoinGrace, "rejoingrace", 0, "rejoin grace sec after heatbeat timeout, 0=disable rejoin")
 	flag.IntVar(&joinTimeout, "jointimeout", 180, "heatbeat timeout sec")
-	flag.IntVar(&listenMode, "listenmode", 3, "0=localnetonly, 1=ipv4+ipv6both, 2=ipv6only, 3=ipv4only, 1=ipv4+ipv6bothauto, 2=ipv6onlyauto, 3=ipv4onlyauto")
+	flag.IntVar(&stackMax, "stackmax", 1024, "max stacked messages per room, older messages are dropped")
+	flag.IntVar(&streamMax, "streammax", 16<<20, "max bytes per relay stream, 0=unlimited")
+	flag.IntVar(&contentMax, "contentmax", 65535, "max content bytes per frame, larger frames are rejected before read")
+	flag.IntVar(&historyMax, "historymax", 0, "max reliable frames kept per room for resend, 0=disable reliable frames, e.g. 256")
+	flag.IntVar(&propMax, "propmax", 256, "max share props per room, 0=unlimited")
+	flag.IntVar(&propValueMax, "propvaluemax", 4096, "max bytes per share prop value, 0=unlimited")
+	flag.IntVar(&minFrameVer, "minframever", defs.MinFrameVersion, "oldest accepted frame version, versions older than the server frame version need a registered adapter")
+	flag.IntVar(&compress, "compress", 0, "default room compression for large latest and legacy map payloads ... 0=off, 1=deflate, 2=zstd")
+	flag.IntVar(&compressMin, "compressmin", 512, "min payload bytes to compress")
+	flag.BoolVar(&authenticate, "auth", false, "default room requires frames signed with the logon session ... false=off, true=on")
+	flag.IntVar(&sessionTtl, "sessionttl", 3600, "logon session expiry sec after its last use, 0=never expire")
+	flag.IntVar(&sessionMax, "sessionmax", 65536, "max logon sessions, logon is refused when full, 0=unlimited")
+	flag.StringVar(&rateLimit, "ratelimit", "", "default room rate limits per player, class:msgs/sec:bytes/sec separated by comma, e.g. relay:60:65536,request:20:16384 ... class=control,relay,latest,prop,request,user, empty=unlimited")
+	flag.IntVar(&kickStrikes, "kickstrikes", 0, "throttled frames within 10 sec before auto kick, 0=never kick")
+	flag.StringVar(&playerDir, "playerdir", "/var/lib/openrelay/players", "player profile directory for load player")
+	flag.IntVar(&listenMode, "listenmode", 3, "0=localnetonly, 1=ipv4+ipv6both, 2=ipv6only, 3=ipv4only, 4=ipv4+ipv6bothauto, 5=ipv6onlyauto, 6=ipv4onlyauto ... auto modes detect global listen addrs, zeromq ports of ipv6only modes bind listen_ipv6 on * hosts, startup fails unless it is an ipv6 addr")
 	flag.StringVar(&listenIpv4, "listen_ipv4", "localhost", "listen global ip addr v4")
 	flag.StringVar(&listenIpv6, "listen_ipv6", "localhost", "listen global ip addr v6")
 	flag.StringVar(&entryHost, "ehost", "localhost", "entry http service listen host")
@@ -73,28 +109,40 @@ func param() {
 	flag.StringVar(&stfSubProto, "stf_sproto", "tcp", "statefull subscribe protocol tcp or udp")
 	flag.StringVar(&stfSubHost, "stf_shost", "*", "statefull subscribe listen host")
 	flag.StringVar(&stfSubPorts, "stf_sports", "7002,7004,7006,7008", "statefull subscribe port, use separate comma")
-	flag.BoolVar(&useStateless, "usestl", false, "enable stateless deal/subscribe services ")
-	flag.StringVar(&stlDealProto, "stl_dproto", "tcp", "stateless dealer protocol tcp or udp")
+	flag.BoolVar(&useStateless, "usestl", false, "enable stateless dtls deal/subscribe services ")
+	flag.StringVar(&stlDealProto, "stl_dproto", "udp", "stateless dealer protocol udp, udp4 or udp6")
 	flag.StringVar(&stlDealHost, "stl_dhost", "*", "stateless dealer listen host")
 	flag.StringVar(&stlDealPorts, "stl_dports", "7001,7003,7005,7007", "stateless dealer port, use separate comma")
-	flag.StringVar(&stlSubProto, "stl_sproto", "tcp", "stateless subscribe protocol tcp or udp")
+	flag.StringVar(&stlSubProto, "stl_sproto", "udp", "stateless subscribe protocol udp, udp4 or udp6")
 	flag.StringVar(&stlSubHost, "stl_shost", "*", "stateless subscribe listen host")
 	flag.StringVar(&stlSubPorts, "stl_sports", "7002,7004,7006,7008", "stateless subscribe port, use separate comma")
+	flag.StringVar(&transports, "transport", "zmq", "statefull relay transport zmq or tcp, use separate comma per room, the first applies to the rest")
+	flag.StringVar(&wsOrigins, "wsorigins", "", "websocket origins allowed on /room/ws/, use separate comma, *=any, empty=same origin only")
 	flag.Parse()
 }
 
 func main() {
 	param()
+	rateLimits, err := srvs.ParseRateLimits(rateLimit)
+	if err != nil {
+		fmt.Println("invalid ratelimit. ", err)
+		os.Exit(1)
+	}
 	o := srvs.NewOpenRelay(entryHost, entryPort,
 		stfDealHost, stfDealProto, stfDealPorts,
 		stfSubHost, stfSubProto, stfSubPorts,
 		stlDealHost, stlDealProto, stlDealPorts,
-		stlSubHost, stlSubProto, stlSubProto,
+		stlSubHost, stlSubProto, stlSubPorts, useStateless,
+		transports, wsOrigins,
 		adminHost, adminPort,
 		listenIpv4, listenIpv6,
 		listenMode, logLevel, logDir,
 		recMode, repMode,
-		hbTimeout, joinTimeout)
+		hbTimeout, rejoinGrace, joinTimeout,
+		stackMax, streamMax, contentMax, historyMax, minFrameVer,
+		propMax, propValueMax,
+		compress, compressMin, authenticate, sessionTtl, sessionMax,
+		rateLimits, kickStrikes, playerDir)
 	o.ServiceInit()
 	defer o.ServiceClose()
 
@@ -52,6 +52,10 @@ do
             HEATBEAT_TIMEOUT=$2
             shift 2
             ;;
+        -rejoingrace)
+            REJOIN_GRACE=$2
+            shift 2
+            ;;
         -jointimeout)
             JOIN_TIMEOUT=$2
             shift 2
@@ -140,6 +144,7 @@ ${DRYRUN} ${IMAGE_PATH}/${IMAGE_NAME} \
 -log=${LOG_LEVEL} \
 -logdir=${LOG_DIRECTORY} \
 -hbtimeout=${HEATBEAT_TIMEOUT} \
+-rejoingrace=${REJOIN_GRACE} \
 -jointimeout=${JOIN_TIMEOUT} \
 -listenmode=${LISTEN_MODE} \
 -listen_ipv4=${LISTEN_IPV4} \
@@ -3,6 +3,8 @@ module openrelay
 go 1.13
 
 require (
-	github.com/pion/dtls v1.5.4 // indirect
+	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.11.13
+	github.com/pion/dtls v1.5.4
 	github.com/zeromq/goczmq v4.1.0+incompatible
 )
@@ -0,0 +1,86 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+const SessionIdSize = 16
+const MacSize = sha256.Size
+
+// TrailerSize is the size of sessionId([16]byte), mac([32]byte) appended to a signed frame.
+const TrailerSize = SessionIdSize + MacSize
+
+// StatelessKeySize is the dtls pre-shared key size for TLS_PSK_WITH_AES_128_CCM_8.
+const StatelessKeySize = 16
+
+// RejoinTokenSize is the size of the rejoin token of a join seed.
+const RejoinTokenSize = 16
+
+var ErrInvalidMac = errors.New("frame mac is invalid")
+
+// Sign appends the session id and HMAC-SHA256 of frame and session id.
+func Sign(frame []byte, sessionId [SessionIdSize]byte, secret []byte) []byte {
+	signed := make([]byte, 0, len(frame)+TrailerSize)
+	signed = append(signed, frame...)
+	signed = append(signed, sessionId[:]...)
+	return append(signed, mac(signed, secret)...)
+}
+
+// Verify checks the trailer of a signed frame, and returns the frame without trailer.
+// secret looks up the session secret, unknown sessions fail.
+func Verify(signed []byte, secret func(sessionId [SessionIdSize]byte) ([]byte, bool)) ([]byte, [SessionIdSize]byte, error) {
+	sessionId := [SessionIdSize]byte{}
+	if len(signed) < HeaderSize+TrailerSize {
+		return nil, sessionId, ErrShortFrame
+	}
+	macStart := len(signed) - MacSize
+	copy(sessionId[:], signed[macStart-SessionIdSize:macStart])
+	key, ok := secret(sessionId)
+	if !ok {
+		return nil, sessionId, errors.New("session is not found")
+	}
+	if !hmac.Equal(signed[macStart:], mac(signed[:macStart], key)) {
+		return nil, sessionId, ErrInvalidMac
+	}
+	return signed[:macStart-SessionIdSize], sessionId, nil
+}
+
+// StatelessKey derives the dtls pre-shared key of a join seed from the room key,
+// the join seed is the psk identity so that handshakes need no room state.
+func StatelessKey(roomKey []byte, joinSeed []byte) []byte {
+	return mac(joinSeed, roomKey)[:StatelessKeySize]
+}
+
+// RejoinToken derives the rejoin token of a join seed from the room key,
+// it is sent to the joined player only, join seeds alone are not enough to rejoin.
+func RejoinToken(roomKey []byte, joinSeed []byte) []byte {
+	return mac(append([]byte("rejoin:"), joinSeed...), roomKey)[:RejoinTokenSize]
+}
+
+// ValidRejoinToken reports whether token is the rejoin token of joinSeed.
+func ValidRejoinToken(roomKey []byte, joinSeed []byte, token []byte) bool {
+	return len(roomKey) != 0 && hmac.Equal(token, RejoinToken(roomKey, joinSeed))
+}
+
+func mac(message []byte, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(message)
+	return h.Sum(nil)
+}
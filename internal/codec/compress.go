@@ -0,0 +1,91 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"math"
+	"openrelay/internal/defs"
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(math.MaxUint16))
+
+// ContentCompression returns the compression bits of a ContentCode.
+func ContentCompression(contentCode byte) byte {
+	return contentCode & defs.CONTENT_COMPRESS_MASK
+}
+
+// Compress compresses content with compression, one of CONTENT_DEFLATE or CONTENT_ZSTD.
+func Compress(compression byte, content []byte) ([]byte, error) {
+	switch compression {
+	case defs.CONTENT_DEFLATE:
+		writeBuf := new(bytes.Buffer)
+		writer, err := flate.NewWriter(writeBuf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(content)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return writeBuf.Bytes(), nil
+	case defs.CONTENT_ZSTD:
+		return zstdEncoder.EncodeAll(content, nil), nil
+	default:
+		return nil, fmt.Errorf("invalid compression %#x", compression)
+	}
+}
+
+// Decompress restores content compressed with compression,
+// restored content must still fit in ContentLen so that it can be relayed to any player.
+func Decompress(compression byte, content []byte) ([]byte, error) {
+	switch compression {
+	case 0:
+		return content, nil
+	case defs.CONTENT_DEFLATE:
+		reader := flate.NewReader(bytes.NewReader(content))
+		defer reader.Close()
+		restored, err := ioutil.ReadAll(io.LimitReader(reader, math.MaxUint16+1))
+		if err != nil {
+			return nil, err
+		}
+		if math.MaxUint16 < len(restored) {
+			return nil, fmt.Errorf("decompressed content is too large")
+		}
+		return restored, nil
+	case defs.CONTENT_ZSTD:
+		restored, err := zstdDecoder.DecodeAll(content, nil)
+		if err != nil {
+			return nil, err
+		}
+		if math.MaxUint16 < len(restored) {
+			return nil, fmt.Errorf("decompressed content is too large")
+		}
+		return restored, nil
+	default:
+		return nil, fmt.Errorf("invalid compression %#x", compression)
+	}
+}
@@ -0,0 +1,169 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"openrelay/internal/defs"
+)
+
+const HeaderSize = 16
+const seqOffset = 14
+
+var ErrShortFrame = errors.New("frame is shorter than header lengths")
+
+// Message is a typed content of a relay frame.
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal(content []byte) error
+}
+
+// DecodeFrame splits a frame into header, dest uids and content, checking DestLen and ContentLen before any read.
+// bytes after the content are left for trailers.
+func DecodeFrame(frame []byte) (defs.Header, []defs.PlayerId, []byte, error) {
+	header, err := PeekHeader(frame)
+	if err != nil {
+		return header, nil, nil, err
+	}
+	if header.DestLen%2 != 0 {
+		return header, nil, nil, fmt.Errorf("invalid DestLen %d, not a multiple of uid size", header.DestLen)
+	}
+	destEnd := HeaderSize + int(header.DestLen) + pad(int(header.DestLen))
+	contentEnd := destEnd + int(header.ContentLen)
+	if len(frame) < contentEnd {
+		return header, nil, nil, ErrShortFrame
+	}
+	destUids := make([]defs.PlayerId, header.DestLen/2)
+	err = binary.Read(bytes.NewReader(frame[HeaderSize:destEnd]), binary.LittleEndian, &destUids)
+	if err != nil {
+		return header, nil, nil, err
+	}
+	return header, destUids, frame[destEnd:contentEnd], nil
+}
+
+// PeekHeader reads the header of frame only.
+func PeekHeader(frame []byte) (defs.Header, error) {
+	header := defs.Header{}
+	if len(frame) < HeaderSize {
+		return header, ErrShortFrame
+	}
+	err := binary.Read(bytes.NewReader(frame[:HeaderSize]), binary.LittleEndian, &header)
+	return header, err
+}
+
+// SetSeq returns a copy of frame stamped with seq.
+func SetSeq(frame []byte, seq uint16) ([]byte, error) {
+	if len(frame) < HeaderSize {
+		return nil, ErrShortFrame
+	}
+	stamped := make([]byte, len(frame))
+	copy(stamped, frame)
+	binary.LittleEndian.PutUint16(stamped[seqOffset:], seq)
+	return stamped, nil
+}
+
+// EncodeFrame writes header, dest uids and msg, DestLen and ContentLen are set from them.
+// msg may be nil for frames without content.
+func EncodeFrame(header defs.Header, destUids []defs.PlayerId, msg Message) ([]byte, error) {
+	var err error
+	content := []byte{}
+	if msg != nil {
+		content, err = msg.Marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if math.MaxUint16 < len(content) {
+		return nil, fmt.Errorf("content is too large %d", len(content))
+	}
+	if math.MaxUint16/2 < len(destUids) {
+		return nil, fmt.Errorf("dest uids are too many %d", len(destUids))
+	}
+	header.DestLen = uint16(2 * len(destUids))
+	header.ContentLen = uint16(len(content))
+	writeBuf := new(bytes.Buffer)
+	err = write(writeBuf, header, destUids)
+	if err != nil {
+		return nil, err
+	}
+	err = writePad(writeBuf, int(header.DestLen))
+	if err != nil {
+		return nil, err
+	}
+	err = write(writeBuf, content)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+// pad is the alignment length following a variable field of n bytes.
+// frame versions 19 and 20 pad n % 4, every codec must use this rule.
+func pad(n int) int {
+	return n % 4
+}
+
+func write(writeBuf *bytes.Buffer, values ...interface{}) error {
+	for _, value := range values {
+		err := binary.Write(writeBuf, binary.LittleEndian, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func read(readBuf *bytes.Reader, values ...interface{}) error {
+	for _, value := range values {
+		err := binary.Read(readBuf, binary.LittleEndian, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePad(writeBuf *bytes.Buffer, n int) error {
+	return write(writeBuf, make([]byte, pad(n)))
+}
+
+func readPad(readBuf *bytes.Reader, n int) error {
+	return read(readBuf, make([]byte, pad(n)))
+}
+
+// readBytes reads a n bytes field, n is checked against the rest of content before allocation.
+func readBytes(readBuf *bytes.Reader, n int) ([]byte, error) {
+	if readBuf.Len() < n {
+		return nil, ErrShortFrame
+	}
+	field := make([]byte, n)
+	err := read(readBuf, field)
+	if err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+func checkLen(name string, n int) error {
+	if math.MaxUint16 < n {
+		return fmt.Errorf("%s is too large %d", name, n)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build go1.18
+// +build go1.18
+
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"bytes"
+	"openrelay/internal/defs"
+	"reflect"
+	"testing"
+)
+
+func FuzzDecodeFrame(f *testing.F) {
+	for uidCount := 0; uidCount < 4; uidCount++ {
+		frame, err := EncodeFrame(defs.Header{Ver: defs.FrameVersion, DestCode: defs.INCLUDE}, make([]defs.PlayerId, uidCount), &Raw{Data: make([]byte, uidCount)})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, HeaderSize-1))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		header, destUids, content, err := DecodeFrame(frame)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeFrame(header, destUids, &Raw{Data: content})
+		if err != nil {
+			t.Fatalf("decoded frame cannot be encoded. %v", err)
+		}
+		if len(frame) < len(encoded) {
+			t.Fatalf("encoded frame %d bytes is longer than decoded frame %d bytes", len(encoded), len(frame))
+		}
+		header2, destUids2, content2, err := DecodeFrame(encoded)
+		if err != nil {
+			t.Fatalf("encoded frame cannot be decoded. %v", err)
+		}
+		if header != header2 || !reflect.DeepEqual(destUids, destUids2) || !bytes.Equal(content, content2) {
+			t.Fatalf("frame round trip mismatch %+v %+v", header, header2)
+		}
+	})
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	ms := messages()
+	for i, m := range ms {
+		content, err := m.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(byte(i), content)
+		f.Add(byte(i), content[:len(content)/2])
+	}
+	f.Fuzz(func(t *testing.T, kind byte, content []byte) {
+		m := newMessage(ms[int(kind)%len(ms)])
+		if m.Unmarshal(content) != nil {
+			return
+		}
+		encoded, err := m.Marshal()
+		if err != nil {
+			t.Fatalf("%T decoded content cannot be encoded. %v", m, err)
+		}
+		decoded := newMessage(m)
+		err = decoded.Unmarshal(encoded)
+		if err != nil {
+			t.Fatalf("%T encoded content cannot be decoded. %v", m, err)
+		}
+		if !reflect.DeepEqual(m, decoded) {
+			t.Fatalf("%T round trip mismatch\n got %+v\nwant %+v", m, decoded, m)
+		}
+	})
+}
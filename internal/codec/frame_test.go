@@ -0,0 +1,80 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"bytes"
+	"openrelay/internal/defs"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	header := defs.Header{Ver: defs.FrameVersion, RelayCode: defs.RELAY, ContentCode: 1, DestCode: defs.INCLUDE, Mask: 2, SrcUid: 3, SrcOid: 4}
+	for uidCount := 0; uidCount < 4; uidCount++ {
+		for contentLen := 0; contentLen < 5; contentLen++ {
+			destUids := make([]defs.PlayerId, uidCount)
+			for i := range destUids {
+				destUids[i] = defs.PlayerId(i + 1)
+			}
+			content := bytes.Repeat([]byte{0xAB}, contentLen)
+			frame, err := EncodeFrame(header, destUids, &Raw{Data: content})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := HeaderSize + 2*uidCount + pad(2*uidCount) + contentLen; len(frame) != want {
+				t.Errorf("frame of %d uids %d content is %d bytes, want %d", uidCount, contentLen, len(frame), want)
+			}
+			decoded, decodedUids, decodedContent, err := DecodeFrame(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := header
+			want.DestLen, want.ContentLen = uint16(2*uidCount), uint16(contentLen)
+			if decoded != want || !reflect.DeepEqual(decodedUids, destUids) || !bytes.Equal(decodedContent, content) {
+				t.Errorf("frame round trip mismatch %+v %v %x", decoded, decodedUids, decodedContent)
+			}
+			if _, _, _, err = DecodeFrame(frame[:len(frame)-1]); len(frame) != HeaderSize && err == nil {
+				t.Errorf("truncated frame of %d uids %d content is accepted", uidCount, contentLen)
+			}
+		}
+	}
+}
+
+func TestDecodeFrameLengths(t *testing.T) {
+	frame, err := EncodeFrame(defs.Header{Ver: defs.FrameVersion}, nil, &Raw{Data: []byte("content")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = PeekHeader(frame[:HeaderSize-1]); err != ErrShortFrame {
+		t.Errorf("short header, got %v", err)
+	}
+	oddDest := append([]byte{}, frame...)
+	oddDest[10] = 1 // DestLen
+	if _, _, _, err = DecodeFrame(oddDest); err == nil {
+		t.Errorf("odd DestLen is accepted")
+	}
+	longContent := append([]byte{}, frame...)
+	longContent[12], longContent[13] = 0xFF, 0xFF // ContentLen
+	if _, _, _, err = DecodeFrame(longContent); err != ErrShortFrame {
+		t.Errorf("ContentLen over frame, got %v", err)
+	}
+	trailed := append(append([]byte{}, frame...), 0, 1, 2, 3)
+	_, _, content, err := DecodeFrame(trailed)
+	if err != nil || string(content) != "content" {
+		t.Errorf("trailer is not left, content %q %v", content, err)
+	}
+}
@@ -0,0 +1,67 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"openrelay/internal/defs"
+)
+
+func init() {
+	RegisterAdapter(defs.LegacyFrameVersion, legacy{})
+}
+
+// legacy adapts frame version 19, which relays RELAY_STREAM content as is without StreamHeader.
+// upgraded stream content is wrapped as a final chunk 0 of stream 0, downgraded chunks lose their StreamHeader.
+// sealed content is left as is, the StreamHeader of sealed chunks is inside the ciphertext.
+// version 19 has no reliable bit, CONTENT_RELIABLE and Seq are cleared both ways.
+type legacy struct{}
+
+func (a legacy) Upgrade(frame []byte) ([]byte, error) {
+	header, destUids, content, err := DecodeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	header.Ver = defs.FrameVersion
+	header.ContentCode &^= defs.CONTENT_RELIABLE
+	header.Seq = 0
+	if header.RelayCode == defs.RELAY_STREAM && header.ContentCode&defs.CONTENT_SEALED == 0 {
+		chunk := StreamChunk{StreamHeader: defs.StreamHeader{Flags: defs.STREAM_FINAL}, Data: content}
+		content, err = chunk.Marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return EncodeFrame(header, destUids, &Raw{Data: content})
+}
+
+func (a legacy) Downgrade(frame []byte) ([]byte, error) {
+	header, destUids, content, err := DecodeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	header.Ver = defs.LegacyFrameVersion
+	header.ContentCode &^= defs.CONTENT_RELIABLE
+	header.Seq = 0
+	if header.RelayCode == defs.RELAY_STREAM && header.ContentCode&defs.CONTENT_SEALED == 0 {
+		chunk := StreamChunk{}
+		err = chunk.Unmarshal(content)
+		if err != nil {
+			return nil, err
+		}
+		content = chunk.Data
+	}
+	return EncodeFrame(header, destUids, &Raw{Data: content})
+}
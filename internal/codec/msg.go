@@ -0,0 +1,464 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"bytes"
+	"openrelay/internal/defs"
+)
+
+// Raw is an opaque content, LEGACY maps, latest, stack push and user define relay codes.
+type Raw struct {
+	Data []byte
+}
+
+func (m *Raw) Marshal() ([]byte, error) {
+	return m.Data, nil
+}
+
+func (m *Raw) Unmarshal(content []byte) error {
+	m.Data = content
+	return nil
+}
+
+// Seed is a join seed content, LEAVE, TIMEOUT, REPLAY_JOIN and LOAD_PLAYER requests.
+type Seed struct {
+	Seed []byte
+}
+
+func (m *Seed) Marshal() ([]byte, error) {
+	return m.Seed, nil
+}
+
+func (m *Seed) Unmarshal(content []byte) error {
+	m.Seed = content
+	return nil
+}
+
+// Join is JOIN request, seedLen(uint16), nameLen(uint16), seed, alignment, name.
+type Join struct {
+	Seed []byte
+	Name []byte
+}
+
+func (m *Join) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := writeSeedName(writeBuf, m.Seed, m.Name)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Join) Unmarshal(content []byte) error {
+	var err error
+	m.Seed, m.Name, err = readSeedName(bytes.NewReader(content))
+	return err
+}
+
+// JoinNotice is JOIN response, assignUid(uint16), masterUid(uint16) and Join.
+// the relay leaves the seed empty, join seeds are not shown to the other players.
+type JoinNotice struct {
+	AssignUid defs.PlayerId
+	MasterUid defs.PlayerId
+	Seed      []byte
+	Name      []byte
+}
+
+func (m *JoinNotice) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.AssignUid, m.MasterUid)
+	if err != nil {
+		return nil, err
+	}
+	err = writeSeedName(writeBuf, m.Seed, m.Name)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *JoinNotice) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	err := read(readBuf, &m.AssignUid, &m.MasterUid)
+	if err != nil {
+		return err
+	}
+	m.Seed, m.Name, err = readSeedName(readBuf)
+	return err
+}
+
+func writeSeedName(writeBuf *bytes.Buffer, seed []byte, name []byte) error {
+	err := checkLen("seed", len(seed))
+	if err != nil {
+		return err
+	}
+	err = checkLen("name", len(name))
+	if err != nil {
+		return err
+	}
+	err = write(writeBuf, uint16(len(seed)), uint16(len(name)), seed)
+	if err != nil {
+		return err
+	}
+	err = writePad(writeBuf, len(seed))
+	if err != nil {
+		return err
+	}
+	return write(writeBuf, name)
+}
+
+func readSeedName(readBuf *bytes.Reader) ([]byte, []byte, error) {
+	var seedLen, nameLen uint16
+	err := read(readBuf, &seedLen, &nameLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, err := readBytes(readBuf, int(seedLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	err = readPad(readBuf, int(seedLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := readBytes(readBuf, int(nameLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	return seed, name, nil
+}
+
+// Master is masterUid(uint16), LEAVE, TIMEOUT, SET_MASTER and GET_MASTER responses.
+type Master struct {
+	MasterUid defs.PlayerId
+}
+
+func (m *Master) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.MasterUid)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Master) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.MasterUid)
+}
+
+// Target is targetUid(uint16), SET_MASTER and GET_LATEST requests.
+type Target struct {
+	Uid defs.PlayerId
+}
+
+func (m *Target) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.Uid)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Target) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.Uid)
+}
+
+// Rejoin is REJOIN response, uid(uint16), masterUid(uint16).
+type Rejoin struct {
+	Uid       defs.PlayerId
+	MasterUid defs.PlayerId
+}
+
+func (m *Rejoin) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.Uid, m.MasterUid)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Rejoin) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.Uid, &m.MasterUid)
+}
+
+// RejoinSeed is REJOIN request, seedLen(uint16), tokenLen(uint16), seed, alignment, token.
+// token is the rejoin token of JoinPrepare, sent to the joined player only.
+type RejoinSeed struct {
+	Seed  []byte
+	Token []byte
+}
+
+func (m *RejoinSeed) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := writeSeedName(writeBuf, m.Seed, m.Token)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *RejoinSeed) Unmarshal(content []byte) error {
+	var err error
+	m.Seed, m.Token, err = readSeedName(bytes.NewReader(content))
+	return err
+}
+
+// LegacyMap is SET_LEGACY_MAP request and response, keysLen(uint16), propsLen(uint16), keys, alignment, props.
+type LegacyMap struct {
+	Keys  []byte
+	Props []byte
+}
+
+func (m *LegacyMap) Marshal() ([]byte, error) {
+	err := checkLen("keys", len(m.Keys))
+	if err != nil {
+		return nil, err
+	}
+	err = checkLen("props", len(m.Props))
+	if err != nil {
+		return nil, err
+	}
+	writeBuf := new(bytes.Buffer)
+	err = write(writeBuf, uint16(len(m.Keys)), uint16(len(m.Props)), m.Keys)
+	if err != nil {
+		return nil, err
+	}
+	err = writePad(writeBuf, len(m.Keys))
+	if err != nil {
+		return nil, err
+	}
+	err = write(writeBuf, m.Props)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *LegacyMap) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	var keysLen, propsLen uint16
+	err := read(readBuf, &keysLen, &propsLen)
+	if err != nil {
+		return err
+	}
+	m.Keys, err = readBytes(readBuf, int(keysLen))
+	if err != nil {
+		return err
+	}
+	err = readPad(readBuf, int(keysLen))
+	if err != nil {
+		return err
+	}
+	m.Props, err = readBytes(readBuf, int(propsLen))
+	return err
+}
+
+// ServerTimestamp is GET_SERVER_TIMESTAMP response, seconds since the room started.
+type ServerTimestamp struct {
+	Timestamp uint16
+}
+
+func (m *ServerTimestamp) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *ServerTimestamp) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.Timestamp)
+}
+
+// ReplayJoin is REPLAY_JOIN response, assignUid(uint16), masterUid(uint16), joined uids until the end.
+type ReplayJoin struct {
+	AssignUid  defs.PlayerId
+	MasterUid  defs.PlayerId
+	JoinedUids []defs.PlayerId
+}
+
+func (m *ReplayJoin) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.AssignUid, m.MasterUid, m.JoinedUids)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *ReplayJoin) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	err := read(readBuf, &m.AssignUid, &m.MasterUid)
+	if err != nil {
+		return err
+	}
+	m.JoinedUids = make([]defs.PlayerId, readBuf.Len()/2)
+	return read(readBuf, m.JoinedUids)
+}
+
+// JoinPrepare is the join_prepare_polling http response,
+// masterUid(uint16), assignUid(uint16), uidsLen(uint16), namesLen(uint16), uids, alignment, { nameLen(uint16), name, alignment }...
+// uids alignment is counted by uidsLen, name alignment is counted with nameLen field.
+// encrypted or stateless rooms append { keyLen(uint16), roomKey, alignment }, keyLen is 0 on unencrypted rooms.
+// stateless rooms append { pskLen(uint16), statelessKey, alignment } after the room key.
+// rooms with rejoin grace append { tokenLen(uint16), rejoinToken, alignment } after them, empty keys are kept before it.
+type JoinPrepare struct {
+	MasterUid    defs.PlayerId
+	AssignUid    defs.PlayerId
+	JoinedUids   []defs.PlayerId
+	Names        [][]byte
+	RoomKey      []byte
+	StatelessKey []byte
+	RejoinToken  []byte
+}
+
+func (m *JoinPrepare) Marshal() ([]byte, error) {
+	err := checkLen("joined uids", len(m.JoinedUids))
+	if err != nil {
+		return nil, err
+	}
+	err = checkLen("names", len(m.Names))
+	if err != nil {
+		return nil, err
+	}
+	writeBuf := new(bytes.Buffer)
+	err = write(writeBuf, m.MasterUid, m.AssignUid, uint16(len(m.JoinedUids)), uint16(len(m.Names)), m.JoinedUids)
+	if err != nil {
+		return nil, err
+	}
+	err = writePad(writeBuf, len(m.JoinedUids))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range m.Names {
+		err = checkLen("name", len(name))
+		if err != nil {
+			return nil, err
+		}
+		err = write(writeBuf, uint16(len(name)), name)
+		if err != nil {
+			return nil, err
+		}
+		err = writePad(writeBuf, 2+len(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.RoomKey) != 0 || len(m.StatelessKey) != 0 || len(m.RejoinToken) != 0 {
+		err = writeKey(writeBuf, m.RoomKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.StatelessKey) != 0 || len(m.RejoinToken) != 0 {
+		err = writeKey(writeBuf, m.StatelessKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.RejoinToken) != 0 {
+		err = writeKey(writeBuf, m.RejoinToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *JoinPrepare) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	var uidsLen, namesLen uint16
+	err := read(readBuf, &m.MasterUid, &m.AssignUid, &uidsLen, &namesLen)
+	if err != nil {
+		return err
+	}
+	if readBuf.Len() < 2*int(uidsLen) {
+		return ErrShortFrame
+	}
+	m.JoinedUids = make([]defs.PlayerId, uidsLen)
+	err = read(readBuf, m.JoinedUids)
+	if err != nil {
+		return err
+	}
+	err = readPad(readBuf, int(uidsLen))
+	if err != nil {
+		return err
+	}
+	m.Names = make([][]byte, 0, namesLen)
+	for i := 0; i < int(namesLen); i++ {
+		var nameLen uint16
+		err = read(readBuf, &nameLen)
+		if err != nil {
+			return err
+		}
+		name, err := readBytes(readBuf, int(nameLen))
+		if err != nil {
+			return err
+		}
+		err = readPad(readBuf, 2+int(nameLen))
+		if err != nil {
+			return err
+		}
+		m.Names = append(m.Names, name)
+	}
+	if readBuf.Len() == 0 {
+		return nil
+	}
+	m.RoomKey, err = readKey(readBuf)
+	if err != nil {
+		return err
+	}
+	if readBuf.Len() == 0 {
+		return nil
+	}
+	m.StatelessKey, err = readKey(readBuf)
+	if err != nil {
+		return err
+	}
+	if readBuf.Len() == 0 {
+		return nil
+	}
+	m.RejoinToken, err = readKey(readBuf)
+	return err
+}
+
+func writeKey(writeBuf *bytes.Buffer, key []byte) error {
+	err := write(writeBuf, uint16(len(key)), key)
+	if err != nil {
+		return err
+	}
+	return writePad(writeBuf, 2+len(key))
+}
+
+func readKey(readBuf *bytes.Reader) ([]byte, error) {
+	var keyLen uint16
+	err := read(readBuf, &keyLen)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readBytes(readBuf, int(keyLen))
+	if err != nil {
+		return nil, err
+	}
+	if keyLen == 0 {
+		key = nil
+	}
+	return key, readPad(readBuf, 2+int(keyLen))
+}
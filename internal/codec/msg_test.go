@@ -0,0 +1,94 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"openrelay/internal/defs"
+	"reflect"
+	"testing"
+)
+
+// messages covers every Message with variable fields of each padding length.
+func messages() []Message {
+	return []Message{
+		&Raw{Data: []byte{1, 2, 3}},
+		&Seed{Seed: []byte("seed")},
+		&Join{Seed: []byte("s"), Name: []byte("name")},
+		&Join{Seed: []byte("seed"), Name: []byte("n")},
+		&JoinNotice{AssignUid: 2, MasterUid: 1, Seed: []byte("se"), Name: []byte("nam")},
+		&JoinNotice{AssignUid: 3, MasterUid: 1, Seed: []byte("see"), Name: []byte{}},
+		&Master{MasterUid: 7},
+		&Target{Uid: 9},
+		&Rejoin{Uid: 4, MasterUid: 2},
+		&RejoinSeed{Seed: []byte("seed"), Token: []byte("token")},
+		&RejoinSeed{Seed: []byte("s"), Token: []byte{}},
+		&LegacyMap{Keys: []byte("k"), Props: []byte("props")},
+		&LegacyMap{Keys: []byte("keys"), Props: []byte{}},
+		&ServerTimestamp{Timestamp: 300},
+		&ReplayJoin{AssignUid: 3, MasterUid: 1, JoinedUids: []defs.PlayerId{1, 2}},
+		&JoinPrepare{MasterUid: 1, AssignUid: 2, JoinedUids: []defs.PlayerId{1}, Names: [][]byte{[]byte("a"), []byte("bb"), []byte{}}},
+		&JoinPrepare{MasterUid: 1, AssignUid: 3, JoinedUids: []defs.PlayerId{1, 2}, Names: [][]byte{[]byte("abc")}, RoomKey: make([]byte, RoomKeySize)},
+		&JoinPrepare{MasterUid: 1, AssignUid: 4, JoinedUids: []defs.PlayerId{1, 2, 3}, Names: [][]byte{}, StatelessKey: []byte("psk")},
+		&JoinPrepare{MasterUid: 1, AssignUid: 5, JoinedUids: []defs.PlayerId{}, Names: [][]byte{}, RoomKey: []byte("k"), StatelessKey: []byte("ps")},
+		&JoinPrepare{MasterUid: 1, AssignUid: 6, JoinedUids: []defs.PlayerId{}, Names: [][]byte{}, RejoinToken: []byte("token")},
+		&StackPushed{Index: 10, Content: []byte("pushed")},
+		&StackFetch{FromIndex: 5},
+		&StackEntries{FirstIndex: 3, Entries: [][]byte{[]byte{}, []byte("a"), []byte("bc"), []byte("def")}},
+		&Users{MasterUid: 1, Users: []User{{Uid: 1, HbAge: 2, State: defs.USER_STATE_CONNECTED, Name: []byte("a")}, {Uid: 2, State: defs.USER_STATE_WAIT_REJOIN, Name: []byte("abcd")}}},
+		&Prop{Key: []byte("key"), Value: []byte("value"), Version: 2},
+		&PropResult{Status: defs.PROP_CONFLICT, Prop: Prop{Key: []byte("ke"), Value: []byte{}, Version: defs.PROP_VERSION_ANY}},
+		&StreamChunk{StreamHeader: defs.StreamHeader{StreamId: 1, ChunkIndex: 2, Flags: defs.STREAM_FINAL}, Data: []byte("chunk")},
+		&Resend{FromSeq: 65530, ToSeq: 4},
+		&Throttle{RelayCode: defs.RELAY, Class: defs.CLASS_RELAY, Strikes: 3},
+		&Error{RelayCode: defs.JOIN, Reason: defs.ERROR_SPOOFED},
+		&FrameVersion{Ver: defs.FrameVersion, MinVer: defs.MinFrameVersion, MaxVer: defs.FrameVersion},
+	}
+}
+
+// newMessage returns an empty message of the same type as m.
+func newMessage(m Message) Message {
+	return reflect.New(reflect.TypeOf(m).Elem()).Interface().(Message)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, m := range messages() {
+		content, err := m.Marshal()
+		if err != nil {
+			t.Fatalf("%T marshal failed. %v", m, err)
+		}
+		decoded := newMessage(m)
+		err = decoded.Unmarshal(content)
+		if err != nil {
+			t.Fatalf("%T unmarshal failed. %v", m, err)
+		}
+		if !reflect.DeepEqual(m, decoded) {
+			t.Errorf("%T round trip mismatch\n got %+v\nwant %+v", m, decoded, m)
+		}
+	}
+}
+
+func TestMessagePadding(t *testing.T) {
+	for n := 0; n < 8; n++ {
+		join := &Join{Seed: make([]byte, n), Name: []byte("name")}
+		content, err := join.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 4 + n + pad(n) + 4; len(content) != want {
+			t.Errorf("join seed %d bytes, content %d bytes, want %d", n, len(content), want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"bytes"
+	"openrelay/internal/defs"
+)
+
+// StackPushed is PUSH_STACK response, index(uint32), content.
+type StackPushed struct {
+	Index   uint32
+	Content []byte
+}
+
+func (m *StackPushed) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.Index, m.Content)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *StackPushed) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	err := read(readBuf, &m.Index)
+	if err != nil {
+		return err
+	}
+	m.Content = content[len(content)-readBuf.Len():]
+	return nil
+}
+
+// StackFetch is FETCH_STACK request, fromIndex(uint32).
+type StackFetch struct {
+	FromIndex uint32
+}
+
+func (m *StackFetch) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.FromIndex)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *StackFetch) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.FromIndex)
+}
+
+// StackEntries is FETCH_STACK response,
+// firstIndex(uint32), count(uint16), alignment(uint16), { len(uint16), content, alignment }...
+type StackEntries struct {
+	FirstIndex uint32
+	Entries    [][]byte
+}
+
+// StackEntrySize is the encoded size of a stacked content of n bytes.
+func StackEntrySize(n int) int {
+	return 2 + n + pad(2+n)
+}
+
+const StackEntriesHeaderSize = 8
+
+func (m *StackEntries) Marshal() ([]byte, error) {
+	err := checkLen("entries", len(m.Entries))
+	if err != nil {
+		return nil, err
+	}
+	writeBuf := new(bytes.Buffer)
+	err = write(writeBuf, m.FirstIndex, uint16(len(m.Entries)), uint16(0))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range m.Entries {
+		err = checkLen("entry", len(entry))
+		if err != nil {
+			return nil, err
+		}
+		err = write(writeBuf, uint16(len(entry)), entry)
+		if err != nil {
+			return nil, err
+		}
+		err = writePad(writeBuf, 2+len(entry))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *StackEntries) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	var count, alignment uint16
+	err := read(readBuf, &m.FirstIndex, &count, &alignment)
+	if err != nil {
+		return err
+	}
+	m.Entries = make([][]byte, 0, count)
+	for i := 0; i < int(count); i++ {
+		var entryLen uint16
+		err = read(readBuf, &entryLen)
+		if err != nil {
+			return err
+		}
+		entry, err := readBytes(readBuf, int(entryLen))
+		if err != nil {
+			return err
+		}
+		err = readPad(readBuf, 2+int(entryLen))
+		if err != nil {
+			return err
+		}
+		m.Entries = append(m.Entries, entry)
+	}
+	return nil
+}
+
+// User is an entry of Users.
+type User struct {
+	Uid   defs.PlayerId
+	HbAge uint16 // seconds since the last heatbeat, or since the disconnect while waiting rejoin.
+	State defs.UserState
+	Name  []byte
+}
+
+// Users is GET_USERS response,
+// masterUid(uint16), count(uint16), { uid(uint16), nameLen(uint16), hbAge(uint16), state(uint16), name, alignment }...
+type Users struct {
+	MasterUid defs.PlayerId
+	Users     []User
+}
+
+func (m *Users) Marshal() ([]byte, error) {
+	err := checkLen("users", len(m.Users))
+	if err != nil {
+		return nil, err
+	}
+	writeBuf := new(bytes.Buffer)
+	err = write(writeBuf, m.MasterUid, uint16(len(m.Users)))
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range m.Users {
+		err = checkLen("name", len(user.Name))
+		if err != nil {
+			return nil, err
+		}
+		err = write(writeBuf, user.Uid, uint16(len(user.Name)), user.HbAge, user.State, user.Name)
+		if err != nil {
+			return nil, err
+		}
+		err = writePad(writeBuf, len(user.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Users) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	var count uint16
+	err := read(readBuf, &m.MasterUid, &count)
+	if err != nil {
+		return err
+	}
+	m.Users = make([]User, 0, count)
+	for i := 0; i < int(count); i++ {
+		user := User{}
+		var nameLen uint16
+		err = read(readBuf, &user.Uid, &nameLen, &user.HbAge, &user.State)
+		if err != nil {
+			return err
+		}
+		user.Name, err = readBytes(readBuf, int(nameLen))
+		if err != nil {
+			return err
+		}
+		err = readPad(readBuf, int(nameLen))
+		if err != nil {
+			return err
+		}
+		m.Users = append(m.Users, user)
+	}
+	return nil
+}
+
+// Prop is SET_SHARE_PROP, GET_SHARE_PROP and DELETE_SHARE_PROP request,
+// keyLen(uint16), valueLen(uint16), version(uint32), key, alignment, value.
+// version in request is the expected current version, 0 is not exists, PROP_VERSION_ANY skips compare.
+type Prop struct {
+	Key     []byte
+	Value   []byte
+	Version uint32
+}
+
+func (m *Prop) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := m.write(writeBuf)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Prop) Unmarshal(content []byte) error {
+	return m.read(bytes.NewReader(content))
+}
+
+func (m *Prop) write(writeBuf *bytes.Buffer) error {
+	err := checkLen("key", len(m.Key))
+	if err != nil {
+		return err
+	}
+	err = checkLen("value", len(m.Value))
+	if err != nil {
+		return err
+	}
+	err = write(writeBuf, uint16(len(m.Key)), uint16(len(m.Value)), m.Version, m.Key)
+	if err != nil {
+		return err
+	}
+	err = writePad(writeBuf, len(m.Key))
+	if err != nil {
+		return err
+	}
+	return write(writeBuf, m.Value)
+}
+
+func (m *Prop) read(readBuf *bytes.Reader) error {
+	var keyLen, valueLen uint16
+	err := read(readBuf, &keyLen, &valueLen, &m.Version)
+	if err != nil {
+		return err
+	}
+	m.Key, err = readBytes(readBuf, int(keyLen))
+	if err != nil {
+		return err
+	}
+	err = readPad(readBuf, int(keyLen))
+	if err != nil {
+		return err
+	}
+	m.Value, err = readBytes(readBuf, int(valueLen))
+	return err
+}
+
+// PropResult is share prop response, status(uint16), alignment(uint16) and Prop.
+type PropResult struct {
+	Status defs.PropStatus
+	Prop
+}
+
+func (m *PropResult) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.Status, uint16(0))
+	if err != nil {
+		return nil, err
+	}
+	err = m.Prop.write(writeBuf)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *PropResult) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	var alignment uint16
+	err := read(readBuf, &m.Status, &alignment)
+	if err != nil {
+		return err
+	}
+	return m.Prop.read(readBuf)
+}
+
+// StreamChunk is RELAY_STREAM content, StreamHeader and chunk data.
+type StreamChunk struct {
+	defs.StreamHeader
+	Data []byte
+}
+
+func (m *StreamChunk) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.StreamHeader, m.Data)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *StreamChunk) Unmarshal(content []byte) error {
+	readBuf := bytes.NewReader(content)
+	err := read(readBuf, &m.StreamHeader)
+	if err != nil {
+		return err
+	}
+	m.Data = content[len(content)-readBuf.Len():]
+	return nil
+}
+
+// Resend is RESEND request and the closing response, fromSeq(uint16), toSeq(uint16) inclusive.
+type Resend struct {
+	FromSeq uint16
+	ToSeq   uint16
+}
+
+func (m *Resend) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.FromSeq, m.ToSeq)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Resend) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.FromSeq, &m.ToSeq)
+}
+
+// Throttle is THROTTLE notice, relayCode(byte), class(byte), strikes(uint16).
+type Throttle struct {
+	RelayCode defs.RelayCode
+	Class     defs.CodeClass
+	Strikes   uint16
+}
+
+func (m *Throttle) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.RelayCode, m.Class, m.Strikes)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Throttle) Unmarshal(content []byte) error {
+	return read(bytes.NewReader(content), &m.RelayCode, &m.Class, &m.Strikes)
+}
+
+// Error is ERROR reply, relayCode(byte) of the rejected frame, alignment(byte), reason(uint16).
+type Error struct {
+	RelayCode defs.RelayCode
+	Reason    defs.ErrorReason
+}
+
+func (m *Error) Marshal() ([]byte, error) {
+	writeBuf := new(bytes.Buffer)
+	err := write(writeBuf, m.RelayCode, byte(0), m.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return writeBuf.Bytes(), nil
+}
+
+func (m *Error) Unmarshal(content []byte) error {
+	var alignment byte
+	return read(bytes.NewReader(content), &m.RelayCode, &alignment, &m.Reason)
+}
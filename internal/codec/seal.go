@@ -0,0 +1,86 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"openrelay/internal/defs"
+)
+
+const RoomKeySize = 32
+const NonceSize = 12
+
+// SealOverhead is the size of nonce([12]byte) and GCM tag([16]byte) around a sealed payload.
+const SealOverhead = NonceSize + 16
+
+var ErrNotSealed = errors.New("content is not sealed")
+
+// NewRoomKey creates a random AES-256 room key.
+func NewRoomKey() ([]byte, error) {
+	key := make([]byte, RoomKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Sealed reports whether content is marked and sized as a sealed payload, without opening it.
+func Sealed(header defs.Header, content []byte) bool {
+	return header.ContentCode&defs.CONTENT_SEALED != 0 && SealOverhead <= len(content)
+}
+
+// Seal encrypts plain with the room key by AES-GCM, nonce(12byte), sealed content.
+// RelayCode and SrcUid of header are authenticated so that the payload cannot be replayed as another player.
+func Seal(key []byte, header defs.Header, plain []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, NonceSize, NonceSize+len(plain)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, sealedData(header)), nil
+}
+
+// Open decrypts a payload sealed by Seal.
+func Open(key []byte, header defs.Header, sealed []byte) ([]byte, error) {
+	if !Sealed(header, sealed) {
+		return nil, ErrNotSealed
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, sealed[:NonceSize], sealed[NonceSize:], sealedData(header))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealedData(header defs.Header) []byte {
+	return []byte{byte(header.RelayCode), byte(header.SrcUid), byte(header.SrcUid >> 8)}
+}
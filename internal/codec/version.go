@@ -0,0 +1,147 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"fmt"
+	"openrelay/internal/defs"
+)
+
+// Adapter translates frames between an older frame version and defs.FrameVersion.
+type Adapter interface {
+	// Upgrade converts a received frame to the current layout.
+	Upgrade(frame []byte) ([]byte, error)
+	// Downgrade converts a current layout frame to the older layout.
+	Downgrade(frame []byte) ([]byte, error)
+}
+
+var adapters = map[byte]Adapter{}
+
+// RegisterAdapter sets the adapter of frame version ver,
+// versions older than defs.FrameVersion are accepted only with an adapter.
+func RegisterAdapter(ver byte, adapter Adapter) {
+	adapters[ver] = adapter
+}
+
+// AdapterOf returns the adapter of frame version ver, false when ver has none.
+func AdapterOf(ver byte) (Adapter, bool) {
+	adapter, ok := adapters[ver]
+	return adapter, ok
+}
+
+// SameLayout is the adapter of an older version sharing the current layout, only the Ver field is rewritten.
+func SameLayout(ver byte) Adapter {
+	return sameLayout{ver}
+}
+
+type sameLayout struct {
+	ver byte
+}
+
+func (a sameLayout) Upgrade(frame []byte) ([]byte, error) {
+	return setVer(frame, defs.FrameVersion)
+}
+
+func (a sameLayout) Downgrade(frame []byte) ([]byte, error) {
+	return setVer(frame, a.ver)
+}
+
+func setVer(frame []byte, ver byte) ([]byte, error) {
+	if len(frame) < HeaderSize {
+		return nil, ErrShortFrame
+	}
+	converted := make([]byte, len(frame))
+	copy(converted, frame)
+	converted[0] = ver
+	return converted, nil
+}
+
+// FrameVersionOf returns the Ver field of frame.
+func FrameVersionOf(frame []byte) (byte, error) {
+	if len(frame) < 1 {
+		return 0, ErrShortFrame
+	}
+	return frame[0], nil
+}
+
+// RelayCodeOf reads the relay code of frame, it is placed next to the version in every frame version.
+func RelayCodeOf(frame []byte) defs.RelayCode {
+	if len(frame) < 2 {
+		return 0
+	}
+	return defs.RelayCode(frame[1])
+}
+
+// Accepts reports whether frames of version ver are accepted with the oldest version minVer,
+// versions older than defs.FrameVersion need a registered adapter.
+func Accepts(ver byte, minVer byte) bool {
+	if ver < minVer || defs.FrameVersion < ver {
+		return false
+	}
+	if ver == defs.FrameVersion {
+		return true
+	}
+	_, ok := AdapterOf(ver)
+	return ok
+}
+
+// Upgrade converts frame of any accepted version to the current layout.
+func Upgrade(frame []byte, minVer byte) ([]byte, error) {
+	ver, err := FrameVersionOf(frame)
+	if err != nil {
+		return nil, err
+	}
+	if !Accepts(ver, minVer) {
+		return nil, fmt.Errorf("unsupported FrameVersion %d, accepts %d - %d with adapters", ver, minVer, defs.FrameVersion)
+	}
+	if ver == defs.FrameVersion {
+		return frame, nil
+	}
+	adapter, _ := AdapterOf(ver)
+	return adapter.Upgrade(frame)
+}
+
+// Downgrade converts a current layout frame to version ver.
+func Downgrade(frame []byte, ver byte) ([]byte, error) {
+	if ver == defs.FrameVersion {
+		return frame, nil
+	}
+	adapter, ok := AdapterOf(ver)
+	if !ok {
+		return nil, fmt.Errorf("FrameVersion %d has no adapter", ver)
+	}
+	return adapter.Downgrade(frame)
+}
+
+// FrameVersion is FRAME_VERSION response,
+// ver(byte) is the negotiated version or 0 when unsupported, minVer(byte), maxVer(byte), alignment(byte).
+type FrameVersion struct {
+	Ver    byte
+	MinVer byte
+	MaxVer byte
+}
+
+func (m *FrameVersion) Marshal() ([]byte, error) {
+	return []byte{m.Ver, m.MinVer, m.MaxVer, 0}, nil
+}
+
+func (m *FrameVersion) Unmarshal(content []byte) error {
+	if len(content) < 3 {
+		return ErrShortFrame
+	}
+	m.Ver, m.MinVer, m.MaxVer = content[0], content[1], content[2]
+	return nil
+}
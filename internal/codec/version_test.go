@@ -0,0 +1,104 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package codec
+
+import (
+	"openrelay/internal/defs"
+	"testing"
+)
+
+func TestUpgradeAdapter(t *testing.T) {
+	const oldVer = defs.MinFrameVersion - 1
+	frame, err := EncodeFrame(defs.Header{Ver: oldVer, RelayCode: defs.RELAY}, nil, &Raw{Data: []byte("content")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Upgrade(frame, oldVer); err == nil {
+		t.Fatalf("version %d without adapter is accepted", oldVer)
+	}
+	if _, err = Downgrade(frame, oldVer); err == nil {
+		t.Fatalf("version %d without adapter is downgraded", oldVer)
+	}
+
+	RegisterAdapter(oldVer, SameLayout(oldVer))
+	defer delete(adapters, oldVer)
+	if _, err = Upgrade(frame, defs.FrameVersion); err == nil {
+		t.Errorf("version %d under min version is accepted", oldVer)
+	}
+	upgraded, err := Upgrade(frame, oldVer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded[0] != defs.FrameVersion {
+		t.Errorf("upgraded Ver %d", upgraded[0])
+	}
+	downgraded, err := Downgrade(upgraded, oldVer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downgraded) != string(frame) {
+		t.Errorf("downgraded frame %x, want %x", downgraded, frame)
+	}
+}
+
+func TestLegacyStream(t *testing.T) {
+	frame, err := EncodeFrame(defs.Header{Ver: defs.LegacyFrameVersion, RelayCode: defs.RELAY_STREAM}, []defs.PlayerId{2}, &Raw{Data: []byte("chunk")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := Upgrade(frame, defs.LegacyFrameVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, content, err := DecodeFrame(upgraded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := StreamChunk{}
+	err = chunk.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Ver != defs.FrameVersion || chunk.Flags != defs.STREAM_FINAL || string(chunk.Data) != "chunk" {
+		t.Errorf("upgraded Ver %d chunk %+v", header.Ver, chunk)
+	}
+	downgraded, err := Downgrade(upgraded, defs.LegacyFrameVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downgraded) != string(frame) {
+		t.Errorf("downgraded frame %x, want %x", downgraded, frame)
+	}
+}
+
+func TestLegacyReliable(t *testing.T) {
+	header := defs.Header{Ver: defs.LegacyFrameVersion, RelayCode: defs.RELAY, ContentCode: defs.CONTENT_RELIABLE | 1, Seq: 7}
+	frame, err := EncodeFrame(header, nil, &Raw{Data: []byte("content")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := Upgrade(frame, defs.LegacyFrameVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err = PeekHeader(upgraded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ContentCode != 1 || header.Seq != 0 {
+		t.Errorf("upgraded ContentCode %#x Seq %d", header.ContentCode, header.Seq)
+	}
+}
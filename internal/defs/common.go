@@ -37,11 +37,16 @@ const REQUIRE_NATIVE_CDK_VERSION = "0.9.8"
 const REQUIRE_UNITY_CDK_VERSION = "0.9.8"
 const REQUIRE_UE4_CDK_VERSION = "0.9.8"
 
-const FrameVersion = 19
+const FrameVersion = 20
+const MinFrameVersion = 19
+
+// LegacyFrameVersion is the frame version before RELAY_STREAM chunks, translated by the codec legacy adapter.
+const LegacyFrameVersion = 19
 const PropKeyLegacy = "LEGACY"
 const PropKeyLegacyLobby = "LEGACY_LOBBY"
 const PropKeyGenericPrefix = "OR_SHARE_PROP_"
 const PropKeyPlayerPrefix = "OR_PLAYER_PROP_"
+const PropKeyPlayerProfilePrefix = PropKeyPlayerPrefix + "PROFILE_"
 
 func NewGuid() ([16]byte, error) {
 	uuid := [16]byte{}
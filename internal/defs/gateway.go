@@ -0,0 +1,103 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package defs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// GatewayIdentityPrefix marks router identities of websocket peers, zeromq requests with it are dropped.
+const GatewayIdentityPrefix = "ws:"
+
+// GatewayPeers holds the websocket peers of a room keyed by identity.
+// each peer has a write queue drained by its own writer, as a websocket connection takes one writer at a time.
+type GatewayPeers struct {
+	mutex     sync.RWMutex
+	queues    map[string]chan []byte
+	lastId    uint64
+	queueSize int
+}
+
+func NewGatewayPeers(queueSize int) *GatewayPeers {
+	return &GatewayPeers{
+		queues:    make(map[string]chan []byte),
+		queueSize: queueSize,
+	}
+}
+
+func IsGatewayIdentity(identity []byte) bool {
+	return bytes.HasPrefix(identity, []byte(GatewayIdentityPrefix))
+}
+
+// Add registers a new peer, and returns its identity and write queue.
+func (g *GatewayPeers) Add() ([]byte, <-chan []byte) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.lastId++
+	identity := []byte(GatewayIdentityPrefix + strconv.FormatUint(g.lastId, 10))
+	queue := make(chan []byte, g.queueSize)
+	g.queues[string(identity)] = queue
+	return identity, queue
+}
+
+// Remove closes the write queue of identity.
+func (g *GatewayPeers) Remove(identity []byte) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if queue, ok := g.queues[string(identity)]; ok {
+		close(queue)
+		delete(g.queues, string(identity))
+	}
+}
+
+func (g *GatewayPeers) Send(identity []byte, frame []byte) error {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	queue, ok := g.queues[string(identity)]
+	if !ok {
+		return fmt.Errorf("gateway peer not found, identity %s", identity)
+	}
+	select {
+	case queue <- frame:
+		return nil
+	default:
+		return fmt.Errorf("gateway peer queue is full, identity %s", identity)
+	}
+}
+
+// Publish queues frame to every peer, peers queueSize frames behind miss it.
+func (g *GatewayPeers) Publish(frame []byte) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for _, queue := range g.queues {
+		select {
+		case queue <- frame:
+		default:
+		}
+	}
+}
+
+func (g *GatewayPeers) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for identity, queue := range g.queues {
+		close(queue)
+		delete(g.queues, identity)
+	}
+}
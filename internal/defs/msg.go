@@ -15,9 +15,7 @@
 
 package defs
 
-import (
-	"github.com/zeromq/goczmq"
-)
+import "sync"
 
 type RelayCode byte
 
@@ -45,6 +43,13 @@ const (
 	REPLAY_JOIN
 	RELAY_STREAM
 	LOAD_PLAYER
+	SET_SHARE_PROP
+	GET_SHARE_PROP
+	DELETE_SHARE_PROP
+	FRAME_VERSION
+	RESEND
+	THROTTLE
+	ERROR
 	// 100 - 199 Platform Dependency RelayCode
 	UNITY_CDK_RELAY        = 100
 	UNITY_CDK_RELAY_LATEST = 101
@@ -53,6 +58,7 @@ const (
 	UE4_CDK_RELAY_LATEST   = 111
 	UE4_CDK_GET_LATEST     = 112
 	// 200 - 255 User Define RelayCode
+	USER_DEFINE_RELAY_CODE_MIN = 200
 )
 
 type ResponseCode uint16
@@ -83,6 +89,61 @@ const (
 	OPENRELAY_RESPONSE_CODE_NG_JOIN_ROOM_SERVER_TIMEOUT
 )
 
+const MASK_ALL = 0xFF
+
+// listen modes of -listenmode, auto modes detect global addresses and are answered as the base mode.
+const (
+	LISTEN_MODE_LOCALNET = iota
+	LISTEN_MODE_BOTH
+	LISTEN_MODE_IPV6
+	LISTEN_MODE_IPV4
+	LISTEN_MODE_BOTH_AUTO
+	LISTEN_MODE_IPV6_AUTO
+	LISTEN_MODE_IPV4_AUTO
+)
+
+// room transports, selected per room by -transport.
+const (
+	TRANSPORT_ZMQ byte = iota
+	TRANSPORT_TCP
+)
+
+// RoomResponse flags.
+const (
+	ROOM_RESPONSE_FLAG_TCP       = 0x20
+	ROOM_RESPONSE_FLAG_STATELESS = 0x40
+	ROOM_RESPONSE_FLAG_STEALTH   = 0x80
+)
+
+// room policy flags on create.
+const (
+	ROOM_FLAG_AUTHENTICATE = 1 << iota
+	ROOM_FLAG_ENCRYPT
+)
+
+// ContentCode upper bits mark reliable, sealed and compressed content, lower bits are left to the cdk.
+// on JOIN, REJOIN and REPLAY_JOIN the compression bits advertise the compressions the player accepts,
+// compression bits are read only on rooms with a compression policy, and only from players who advertised them.
+// reliable relay frames must be published to the whole room, OTHERS or ALL without mask, others are rejected.
+// the reliable bit is read from frame version 20 on rooms keeping a history only, -historymax is 0 by default.
+const (
+	CONTENT_RELIABLE      = 0x10
+	CONTENT_SEALED        = 0x20
+	CONTENT_DEFLATE       = 0x40
+	CONTENT_ZSTD          = 0x80
+	CONTENT_COMPRESS_MASK = CONTENT_DEFLATE | CONTENT_ZSTD
+)
+
+type PropStatus uint16
+
+const (
+	PROP_OK PropStatus = iota
+	PROP_NOT_FOUND
+	PROP_CONFLICT
+)
+
+const PROP_VERSION_ANY = 0xFFFFFFFF
+
 const (
 	OTHERS = iota
 	ALL
@@ -91,6 +152,36 @@ const (
 	EXCLUDE
 )
 
+type UserState uint16
+
+const (
+	USER_STATE_CONNECTED UserState = iota
+	USER_STATE_WAIT_REJOIN
+)
+
+const (
+	STREAM_FINAL uint16 = 1 << iota
+	STREAM_CANCEL
+)
+
+//8byte, follows Header and dest uids on RELAY_STREAM
+type StreamHeader struct {
+	StreamId   uint16
+	ChunkIndex uint16
+	Flags      uint16  // final | cancel
+	_          [2]byte // 4byte alignment
+}
+
+type StreamKey struct {
+	Uid      PlayerId
+	StreamId uint16
+}
+
+type StreamState struct {
+	NextIndex uint16
+	Size      int
+}
+
 const (
 	BLOCK_ROOM_MAX           = iota // Eager join retry
 	BLOCK_ROOM_AND_QUEUE_MAX        // Economy join retry
@@ -115,7 +206,7 @@ type Header struct {
 	SrcOid      ObjectId
 	DestLen     uint16 // 4byte
 	ContentLen  uint16
-	_           [2]byte // 4byte
+	Seq         uint16 // 4byte, room sequence of published frames, 0=unsequenced
 }
 
 type RoomParameter struct {
@@ -128,9 +219,15 @@ type RoomParameter struct {
 	ListenMode    byte
 	StfDealPort   uint16
 	StfSubPort    uint16
+	Transport     byte
 	UseStateless  bool
 	StlDealPort   uint16
 	StlSubPort    uint16
+	Compression   byte
+	CompressMin   int
+	Authenticate  bool
+	Encrypt       bool
+	Limits        [CLASS_COUNT]RateLimit
 }
 
 type RoomInstance struct {
@@ -138,9 +235,29 @@ type RoomInstance struct {
 	Uids          map[PlayerId]string
 	Names         map[PlayerId]string
 	Hbs           map[PlayerId]int64
+	Dcs           map[PlayerId]int64
 	Props         map[string][]byte
-	Router        *goczmq.Sock
-	Pub           *goczmq.Sock
+	PropVersions  map[string]uint32
+	Identities    map[PlayerId][]byte
+	Vers          map[PlayerId]byte
+	Accepts       map[PlayerId]byte
+	SessionIds    map[PlayerId][16]byte
+	Rates         map[PlayerId]*PlayerRate
+	Masks         map[PlayerId]byte
+	Loading       map[PlayerId]bool
+	Streams       map[StreamKey]StreamState
+	Stack         [][]byte
+	StackHead     uint32
+	SpoofCount    int
+	RoomKey       *RoomKey
+	Seq           uint16
+	History       []SentFrame
+	Transport     Transport
+	Stl           *StatelessConns
+	Gateway       *GatewayPeers
+	Inbox         chan [][]byte
+	Tasks         chan func()
+	Done          chan struct{}
 	LastUid       PlayerId
 	MasterUid     PlayerId
 	MasterUidNeed bool
@@ -149,6 +266,24 @@ type RoomInstance struct {
 	ABLoop        ABLoop
 }
 
+// RoomKey is the key of a room, read by the entry and dtls handshakes while clean replaces it.
+type RoomKey struct {
+	mutex sync.RWMutex
+	key   []byte
+}
+
+func (k *RoomKey) Get() []byte {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.key
+}
+
+func (k *RoomKey) Set(key []byte) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.key = key
+}
+
 type RoomResponse struct {
 	Id             [16]byte // 16byte
 	Capacity       uint16
@@ -158,7 +293,7 @@ type RoomResponse struct {
 	StlDealPort    uint16
 	StlSubPort     uint16 // 4byte
 	QueuingPolicy  byte
-	Flags          byte //stealth | useStateless |x|x|x|x|x|x
+	Flags          byte //stealth | useStateless | tcp |x|x|x|x|x
 	NameLen        byte
 	FilterLen      byte      // 4byte
 	Name           [256]byte // 256byte
@@ -169,6 +304,72 @@ type RoomResponse struct {
 	ListenAddrIpv6 [16]byte
 }
 
+// 48byte, logon response.
+type LogonResponse struct {
+	SessionId [16]byte
+	Secret    [32]byte
+}
+
+// ErrorReason is carried by ERROR replies for rejected frames.
+type ErrorReason uint16
+
+const (
+	ERROR_UNKNOWN ErrorReason = iota
+	ERROR_UNSUPPORTED_VERSION
+	ERROR_TRUNCATED_FRAME
+	ERROR_FRAME_TOO_LARGE
+	ERROR_INVALID_UID
+	ERROR_SPOOFED
+	ERROR_UNAUTHENTICATED
+	ERROR_UNSEALED
+	ERROR_INVALID_CONTENT
+	ERROR_DENIED
+	ERROR_NOT_FOUND
+	ERROR_UNKNOWN_CODE
+	ERROR_HANDLER_FAILED
+	ERROR_LIMIT_EXCEEDED
+)
+
+// CodeClass groups relay codes for rate limiting.
+type CodeClass byte
+
+const (
+	CLASS_CONTROL CodeClass = iota
+	CLASS_RELAY
+	CLASS_LATEST
+	CLASS_PROP
+	CLASS_REQUEST
+	CLASS_USER
+	CLASS_COUNT
+)
+
+// RateLimit is a token bucket refilled per second, 0=unlimited.
+type RateLimit struct {
+	Msgs  int
+	Bytes int
+}
+
+type Bucket struct {
+	Msgs  float64
+	Bytes float64
+	Last  int64
+}
+
+// PlayerRate is the rate state of a player, strikes count dropped frames until the player calms down.
+type PlayerRate struct {
+	Buckets    [CLASS_COUNT]Bucket
+	Strikes    int
+	LastOver   int64
+	LastNotice int64
+}
+
+// SentFrame is a reliable published frame kept for RESEND.
+type SentFrame struct {
+	Seq   uint16
+	Mask  byte
+	Frame []byte
+}
+
 type RoomJoinRequest struct {
 	Seed      string
 	Timestamp int64
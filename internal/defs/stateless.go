@@ -0,0 +1,131 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package defs
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+// StatelessIdentityPrefix marks router identities of dtls connections, zeromq requests with it are dropped.
+const StatelessIdentityPrefix = "stl:"
+
+// StatelessConns holds the dtls connections of a room.
+// deal connections are keyed by identity and carry requests and replies,
+// sub connections are keyed by join seed and receive published frames.
+// every deal keeps the join seed it authenticated with as psk identity.
+type StatelessConns struct {
+	mutex sync.RWMutex
+	deals map[string]net.Conn
+	seeds map[string][]byte
+	subs  map[string]net.Conn
+}
+
+func NewStatelessConns() *StatelessConns {
+	return &StatelessConns{
+		deals: make(map[string]net.Conn),
+		seeds: make(map[string][]byte),
+		subs:  make(map[string]net.Conn),
+	}
+}
+
+func StatelessIdentity(addr net.Addr) []byte {
+	return []byte(StatelessIdentityPrefix + addr.String())
+}
+
+func IsStatelessIdentity(identity []byte) bool {
+	return bytes.HasPrefix(identity, []byte(StatelessIdentityPrefix))
+}
+
+func (s *StatelessConns) AddDeal(identity []byte, seed []byte, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old, ok := s.deals[string(identity)]; ok {
+		old.Close()
+	}
+	s.deals[string(identity)] = conn
+	s.seeds[string(identity)] = seed
+}
+
+func (s *StatelessConns) AddSub(seed []byte, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old, ok := s.subs[string(seed)]; ok {
+		old.Close()
+	}
+	s.subs[string(seed)] = conn
+}
+
+func (s *StatelessConns) Deal(identity []byte) (net.Conn, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	conn, ok := s.deals[string(identity)]
+	return conn, ok
+}
+
+// DealSeed returns the join seed the deal connection of identity authenticated with.
+func (s *StatelessConns) DealSeed(identity []byte) ([]byte, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	seed, ok := s.seeds[string(identity)]
+	return seed, ok
+}
+
+func (s *StatelessConns) Subs() []net.Conn {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	conns := make([]net.Conn, 0, len(s.subs))
+	for _, conn := range s.subs {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// RemoveDeal closes the deal connection of identity, conn guards a newer connection of the same identity.
+func (s *StatelessConns) RemoveDeal(identity []byte, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, ok := s.deals[string(identity)]; ok && (conn == nil || current == conn) {
+		current.Close()
+		delete(s.deals, string(identity))
+		delete(s.seeds, string(identity))
+	}
+}
+
+// RemoveSub closes the sub connection of seed, conn guards a newer connection of the same seed.
+func (s *StatelessConns) RemoveSub(seed []byte, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, ok := s.subs[string(seed)]; ok && (conn == nil || current == conn) {
+		current.Close()
+		delete(s.subs, string(seed))
+	}
+}
+
+func (s *StatelessConns) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for identity, conn := range s.deals {
+		conn.Close()
+		delete(s.deals, identity)
+		delete(s.seeds, identity)
+	}
+	for seed, conn := range s.subs {
+		conn.Close()
+		delete(s.subs, seed)
+	}
+}
@@ -0,0 +1,28 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package defs
+
+// Transport carries the frames of a room.
+// Recv returns identity and frame of the next request, Send answers one peer by identity,
+// Publish delivers a frame to every subscriber of the room.
+// Recv also returns the requests of the room inbox, such as dtls and websocket requests and loop wakes.
+// Recv, Send and Publish are called from the relay loop only.
+type Transport interface {
+	Recv() ([][]byte, error)
+	Send(identity []byte, frame []byte) error
+	Publish(frame []byte) error
+	Close()
+}
@@ -0,0 +1,98 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package relay
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// IdentityPrefix marks identities of tcp clients.
+const IdentityPrefix = "tcp:"
+
+var ErrQueueFull = errors.New("client queue is full")
+var ErrClientClosed = errors.New("client is closed")
+
+type ClientId uint32
+
+// Client is a tcp connection with its own write queue, frames are written in order by the write loop.
+type Client struct {
+	id       ClientId
+	identity []byte
+	conn     net.Conn
+	queue    chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func NewClient(id ClientId, conn net.Conn, queueSize int) *Client {
+	cli := &Client{
+		id:       id,
+		identity: []byte(IdentityPrefix + strconv.FormatUint(uint64(id), 10)),
+		conn:     conn,
+		queue:    make(chan []byte, queueSize),
+		closed:   make(chan struct{}),
+	}
+	go cli.writeLoop()
+	return cli
+}
+
+func (c *Client) Id() ClientId {
+	return c.id
+}
+
+func (c *Client) Identity() []byte {
+	return c.identity
+}
+
+// Send queues frame without blocking, a client behind by queueSize frames misses frames as zeromq hwm does.
+func (c *Client) Send(frame []byte) error {
+	select {
+	case <-c.closed:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case c.queue <- frame:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (c *Client) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func (c *Client) writeLoop() {
+	for {
+		select {
+		case frame := <-c.queue:
+			err := WriteFrame(c.conn, frame)
+			if err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
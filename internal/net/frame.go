@@ -0,0 +1,57 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameLenSize is the size of the uint32 little endian length prefixed to each frame on tcp.
+const FrameLenSize = 4
+
+var ErrFrameTooLarge = errors.New("frame is larger than frame max")
+
+// WriteFrame writes frame with its length prefix in one write.
+func WriteFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, FrameLenSize+len(frame))
+	binary.LittleEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[FrameLenSize:], frame)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a length prefixed frame, the length is checked against frameMax before the frame is read.
+func ReadFrame(r *bufio.Reader, frameMax int) ([]byte, error) {
+	prefix := make([]byte, FrameLenSize)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+	frameLen := binary.LittleEndian.Uint32(prefix)
+	if uint32(frameMax) < frameLen {
+		return nil, fmt.Errorf("%w, %d > %d", ErrFrameTooLarge, frameLen, frameMax)
+	}
+	frame := make([]byte, frameLen)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
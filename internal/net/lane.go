@@ -16,22 +16,13 @@
 package relay
 
 import (
-	"fmt"
-	"net"
-	"runtime"
-	"time"
+	"sync"
 )
 
 const SUBSCRIBERS_PEEK = 65535
+const MSG_QUEUE_PEEK = 4096
 
-//const MSG_QUEUE_PEEK = 65535
 type SubscriberIndex uint16
-type PlayerId uint16
-
-type Client struct {
-	id   PlayerId
-	conn *net.Conn
-}
 
 type Subscriber struct {
 	index SubscriberIndex
@@ -40,149 +31,190 @@ type Subscriber struct {
 	cli   *Client
 }
 
+// Lane fans out broadcast frames to subscribers.
+// subscribers are linked through a pool of chunks, adds and removes are applied by the maintenance loop
+// while the broadcast loop walks the list and queues frames to each client.
 type Lane struct {
 	Name       string
 	Id         byte
 	entryPoint *Subscriber
 	outPoint   *Subscriber
-	newIndex   SubscriberIndex
 	chunks     [SUBSCRIBERS_PEEK]Subscriber
 	avails     []SubscriberIndex
+	listMutex  sync.RWMutex
+	queueMutex sync.Mutex
 	adds       []*Client
 	marks      []*Client
-	msgQueue   []*[]byte
+	msgQueue   chan []byte
+	maintain   chan struct{}
+	done       chan struct{}
+	once       sync.Once
 }
 
 func NewLane(laneId byte, laneName string) *Lane {
-	initialChunks := [SUBSCRIBERS_PEEK]Subscriber{}
-	initialAvails := make([]SubscriberIndex, 0)
-	for index := SubscriberIndex(0); index < SUBSCRIBERS_PEEK; index++ {
-		initialChunks[index] = Subscriber{index, nil, nil, nil}
-		initialAvails = append(initialAvails, index)
-	}
-	return &Lane{
+	s := &Lane{
 		Name:       laneName,
 		Id:         laneId,
 		entryPoint: nil,
 		outPoint:   nil,
-		newIndex:   0,
-		chunks:     initialChunks,
-		avails:     nil,
+		avails:     make([]SubscriberIndex, 0, SUBSCRIBERS_PEEK),
 		adds:       nil,
 		marks:      nil,
-		msgQueue:   nil,
+		msgQueue:   make(chan []byte, MSG_QUEUE_PEEK),
+		maintain:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	for index := SubscriberIndex(0); index < SUBSCRIBERS_PEEK; index++ {
+		s.chunks[index] = Subscriber{index, nil, nil, nil}
+		s.avails = append(s.avails, index)
 	}
+	go s.maintenanceLoop()
+	go s.broadcastLoop()
+	return s
 }
 
-//atomic
+// Add subscribes cli, safe to call from any goroutine.
 func (s *Lane) Add(cli *Client) {
-	// lock // id check
+	s.queueMutex.Lock()
 	s.adds = append(s.adds, cli)
+	s.queueMutex.Unlock()
+	s.wake()
 }
 
-//atomic
+// Remove unsubscribes and closes cli, safe to call from any goroutine.
 func (s *Lane) Remove(cli *Client) {
-	// lock // id check
+	s.queueMutex.Lock()
 	s.marks = append(s.marks, cli)
+	s.queueMutex.Unlock()
+	s.wake()
 }
 
-func (s *Lane) Broadcast(msg *[]byte) {
-	s.msgQueue = append(s.msgQueue, msg)
+// Broadcast queues msg to every subscriber, msg is dropped while the lane is MSG_QUEUE_PEEK frames behind.
+func (s *Lane) Broadcast(msg []byte) error {
+	select {
+	case s.msgQueue <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops the loops and closes every subscriber.
+func (s *Lane) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.listMutex.Lock()
+		defer s.listMutex.Unlock()
+		for sub := s.entryPoint; sub != nil; sub = sub.next {
+			sub.cli.Close()
+		}
+	})
+}
+
+func (s *Lane) wake() {
+	select {
+	case s.maintain <- struct{}{}:
+	default:
+	}
 }
 
 func (s *Lane) newChunk() *Subscriber {
-	index := s.newIndex
-	s.newIndex += 1
-	s.avails = append(s.avails[:index], s.avails[index+1:]...)
+	if len(s.avails) == 0 {
+		return nil
+	}
+	index := s.avails[0]
+	s.avails = s.avails[1:]
 	return &s.chunks[index]
 }
 
 func (s *Lane) releaseChunk(index SubscriberIndex) {
+	s.chunks[index].prev = nil
 	s.chunks[index].next = nil
 	s.chunks[index].cli = nil
 	// quick recycle
-	newAvails := []SubscriberIndex{index}
-	newAvails = append(newAvails, s.avails...)
-	s.avails = newAvails // or quick recycle?
-
-	// latest recycle
-	//s.avails = append(s.avails, index)
+	s.avails = append(s.avails, index)
 }
 
-func (s *Lane) existsCli(cli *Client, index *SubscriberIndex) bool {
-	sub := s.entryPoint
-	for sub != nil {
+func (s *Lane) existsCli(cli *Client) (SubscriberIndex, bool) {
+	for sub := s.entryPoint; sub != nil; sub = sub.next {
 		if sub.cli.id == cli.id {
-			index = &sub.index
-			return true
+			return sub.index, true
 		}
-		sub = sub.next
-		runtime.Gosched()
 	}
-	index = nil
-	return false
+	return 0, false
 }
 
 func (s *Lane) maintenanceLoop() {
 	for {
-		for 0 < len(s.adds) {
-			// TODO at first another logic..
-			// TODO set entryPoint
-
-			addCli := s.adds[0]
-			s.adds = s.adds[1:]
-			if s.existsCli(addCli, nil) {
+		select {
+		case <-s.maintain:
+		case <-s.done:
+			return
+		}
+		s.queueMutex.Lock()
+		adds, marks := s.adds, s.marks
+		s.adds, s.marks = nil, nil
+		s.queueMutex.Unlock()
+
+		s.listMutex.Lock()
+		for _, addCli := range adds {
+			if _, ok := s.existsCli(addCli); ok {
 				continue
 			}
 			sub := s.newChunk()
+			if sub == nil {
+				// no chunk left, the lane is full.
+				addCli.Close()
+				continue
+			}
 			sub.cli = addCli
 			sub.next = nil
 			sub.prev = s.outPoint
 			// acvivate
-			s.outPoint.next = sub
+			if s.outPoint == nil {
+				s.entryPoint = sub
+			} else {
+				s.outPoint.next = sub
+			}
 			// change point
 			s.outPoint = sub
 		}
-		for 0 < len(s.marks) {
-			// TODO at first another logic..
-
-			markCli := s.marks[0]
-			s.marks = s.marks[1:]
-			var index SubscriberIndex
-			if !s.existsCli(markCli, &index) {
+		for _, markCli := range marks {
+			index, ok := s.existsCli(markCli)
+			if !ok {
 				continue
 			}
-			// TODO set entryPoint
-			// TODO set outPoint
+			sub := &s.chunks[index]
+			if sub.prev == nil {
+				s.entryPoint = sub.next
+			} else {
+				sub.prev.next = sub.next
+			}
+			if sub.next == nil {
+				s.outPoint = sub.prev
+			} else {
+				sub.next.prev = sub.prev
+			}
 			// purged
-			s.chunks[index].prev.next = s.chunks[index].next
-			s.chunks[index].prev = nil
+			markCli.Close()
 			s.releaseChunk(index)
 		}
-		time.Sleep(0 * time.Second) // force return context
-		// runtime.Gosched()
+		s.listMutex.Unlock()
 	}
 }
 
 func (s *Lane) broadcastLoop() {
-	sub := s.entryPoint
 	for {
-		for 0 < len(s.msgQueue) {
-			msg := s.msgQueue[0]
-			s.msgQueue = s.msgQueue[1:]
-			for sub != nil {
-				fmt.Printf("msg %s -> cli", *msg, sub.cli.id)
-				_, err := (*sub.cli.conn).Write(*msg)
-				if err != nil {
-					fmt.Printf("Failed to write message to %s: %v\n", (*sub.cli.conn).RemoteAddr(), err)
-				}
-				sub = sub.next
-				runtime.Gosched()
+		select {
+		case msg := <-s.msgQueue:
+			s.listMutex.RLock()
+			for sub := s.entryPoint; sub != nil; sub = sub.next {
+				// slow subscribers miss msg, the others are not blocked.
+				sub.cli.Send(msg)
 			}
-			sub = s.entryPoint
-			runtime.Gosched()
+			s.listMutex.RUnlock()
+		case <-s.done:
+			return
 		}
-		time.Sleep(0 * time.Second) // force return context
-		// runtime.Gosched()
 	}
 }
@@ -16,52 +16,85 @@
 package relay
 
 import (
-	"fmt"
+	"bufio"
+	"sync"
 )
 
 const bufSize = 8192
 
-// Receiver is a helper to handle one to many chat
+// Receiver reads length prefixed frames of deal clients into one request queue, as a zeromq router does.
 type Receiver struct {
-	clients map[PlayerId]Client
+	mutex      sync.RWMutex
+	clients    map[ClientId]*Client
+	identities map[string]*Client
+	requests   chan [][]byte
+	frameMax   int
 }
 
-// NewReceiver builds a new hub
-func NewReceiver() *Receiver {
-	return &Receiver{clients: make(map[PlayerId]Client)}
+// NewReceiver builds a new receiver, requests are queued up to queueSize and readers wait beyond it.
+func NewReceiver(queueSize int, frameMax int) *Receiver {
+	return &Receiver{
+		clients:    make(map[ClientId]*Client),
+		identities: make(map[string]*Client),
+		requests:   make(chan [][]byte, queueSize),
+		frameMax:   frameMax,
+	}
 }
 
-// Register adds a new conn to the Receiver
-func (r *Receiver) Add(cli Client) {
-	fmt.Printf("Connected to %s\n", (*cli.conn).RemoteAddr())
-	fmt.Printf("Connected to %v\n", cli.id)
+// Add registers cli and starts its read loop.
+func (r *Receiver) Add(cli *Client) {
+	r.mutex.Lock()
 	r.clients[cli.id] = cli
+	r.identities[string(cli.identity)] = cli
+	r.mutex.Unlock()
 
 	go r.readLoop(cli)
 }
 
-func (r *Receiver) Remove(cli Client) {
+func (r *Receiver) Remove(cli *Client) {
+	r.mutex.Lock()
 	delete(r.clients, cli.id)
-	err := (*cli.conn).Close()
-	if err != nil {
-		fmt.Println("Failed to disconnect %s", (*cli.conn).RemoteAddr())
-		fmt.Println("Failed to disconnect %v %s", cli.id, err)
-	} else {
-		fmt.Println("Disconnected ", (*cli.conn).RemoteAddr())
+	delete(r.identities, string(cli.identity))
+	r.mutex.Unlock()
+	cli.Close()
+}
+
+// Client finds the client of identity.
+func (r *Receiver) Client(identity []byte) (*Client, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	cli, ok := r.identities[string(identity)]
+	return cli, ok
+}
+
+// Requests delivers identity and frame pairs.
+func (r *Receiver) Requests() <-chan [][]byte {
+	return r.requests
+}
+
+// Close closes every client, the request queue is left open for pending readers.
+func (r *Receiver) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, cli := range r.clients {
+		cli.Close()
+		delete(r.clients, id)
+		delete(r.identities, string(cli.identity))
 	}
 }
 
-func (r *Receiver) readLoop(cli Client) {
-	b := make([]byte, bufSize)
+func (r *Receiver) readLoop(cli *Client) {
+	defer r.Remove(cli)
+	reader := bufio.NewReaderSize(cli.conn, bufSize)
 	for {
-		n, err := (*cli.conn).Read(b)
+		frame, err := ReadFrame(reader, r.frameMax)
 		if err != nil {
-			r.Remove(cli)
 			return
 		}
-		fmt.Printf("Got message: %s\n", string(b[:n]))
+		select {
+		case r.requests <- [][]byte{cli.identity, frame}:
+		case <-cli.closed:
+			return
+		}
 	}
 }
-
-// TODO need queing message logic.
-// TODO need Client dispose logic.
@@ -0,0 +1,116 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package relay
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+)
+
+// Server is the tcp transport of a room, a cgo free counterpart of the zeromq router and pub pair.
+// deal clients send requests and receive replies by identity, sub clients receive broadcast frames.
+type Server struct {
+	deal      net.Listener
+	sub       net.Listener
+	receiver  *Receiver
+	lane      *Lane
+	queueSize int
+	lastId    uint32
+}
+
+// Listen binds the deal and sub addresses, queueSize bounds the request queue and each client write queue.
+func Listen(proto string, dealAddr string, subAddr string, queueSize int, frameMax int) (*Server, error) {
+	deal, err := net.Listen(proto, dealAddr)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := net.Listen(proto, subAddr)
+	if err != nil {
+		deal.Close()
+		return nil, err
+	}
+	s := &Server{
+		deal:      deal,
+		sub:       sub,
+		receiver:  NewReceiver(queueSize, frameMax),
+		lane:      NewLane(0, subAddr),
+		queueSize: queueSize,
+	}
+	go s.acceptDeals()
+	go s.acceptSubs()
+	return s, nil
+}
+
+// Requests delivers identity and frame pairs of deal clients.
+func (s *Server) Requests() <-chan [][]byte {
+	return s.receiver.Requests()
+}
+
+// Send queues frame to the deal client of identity.
+func (s *Server) Send(identity []byte, frame []byte) error {
+	cli, ok := s.receiver.Client(identity)
+	if !ok {
+		return fmt.Errorf("client not found, identity %s", identity)
+	}
+	return cli.Send(frame)
+}
+
+// Broadcast queues frame to every sub client.
+func (s *Server) Broadcast(frame []byte) error {
+	return s.lane.Broadcast(frame)
+}
+
+func (s *Server) Close() {
+	s.deal.Close()
+	s.sub.Close()
+	s.receiver.Close()
+	s.lane.Close()
+}
+
+func (s *Server) newId() ClientId {
+	return ClientId(atomic.AddUint32(&s.lastId, 1))
+}
+
+func (s *Server) acceptDeals() {
+	for {
+		conn, err := s.deal.Accept()
+		if err != nil {
+			return
+		}
+		s.receiver.Add(NewClient(s.newId(), conn, s.queueSize))
+	}
+}
+
+func (s *Server) acceptSubs() {
+	for {
+		conn, err := s.sub.Accept()
+		if err != nil {
+			return
+		}
+		cli := NewClient(s.newId(), conn, s.queueSize)
+		s.lane.Add(cli)
+		go s.watchSub(cli)
+	}
+}
+
+// watchSub drops what a sub client sends, and removes the client when it disconnects.
+func (s *Server) watchSub(cli *Client) {
+	io.Copy(ioutil.Discard, cli.conn)
+	s.lane.Remove(cli)
+}
@@ -0,0 +1,138 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+)
+
+// Compression converts the compress option, 0=off, 1=deflate, 2=zstd, to ContentCode bits.
+func Compression(option int) byte {
+	switch option {
+	case 1:
+		return defs.CONTENT_DEFLATE
+	case 2:
+		return defs.CONTENT_ZSTD
+	default:
+		return 0
+	}
+}
+
+// readContent restores compressed content of a request that the server interprets or stores.
+// compression bits are read only on rooms with a compression policy, from players who advertised them on join,
+// otherwise ContentCode is left to the cdk as is.
+func readContent(room *defs.RoomParameter, relay *defs.RoomInstance, header *defs.Header, content []byte) ([]byte, error) {
+	if room.Compression == 0 {
+		return content, nil
+	}
+	compression := codec.ContentCompression(header.ContentCode)
+	if compression == 0 || !accepts(relay, header.SrcUid, compression) {
+		return content, nil
+	}
+	header.ContentCode &^= defs.CONTENT_COMPRESS_MASK
+	return codec.Decompress(compression, content)
+}
+
+// readAccepts takes the compressions advertised on join, on rooms with a compression policy only.
+func readAccepts(room *defs.RoomParameter, relay *defs.RoomInstance, header *defs.Header, uid defs.PlayerId) {
+	if room.Compression == 0 {
+		return
+	}
+	relay.Accepts[uid] = codec.ContentCompression(header.ContentCode)
+	header.ContentCode &^= defs.CONTENT_COMPRESS_MASK
+}
+
+func accepts(relay *defs.RoomInstance, uid defs.PlayerId, compression byte) bool {
+	return relay.Accepts[uid]&compression != 0
+}
+
+// compress returns compressed content under the room policy, nil when it should be sent as is.
+func compress(room *defs.RoomParameter, content []byte) ([]byte, error) {
+	if room.Compression == 0 || len(content) < room.CompressMin {
+		return nil, nil
+	}
+	compressed, err := codec.Compress(room.Compression, content)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) <= len(compressed) {
+		return nil, nil
+	}
+	return compressed, nil
+}
+
+// publishCompressed publishes msg compressed to the players accepting the room compression,
+// when the players are mixed, each player gets its own frame point to point.
+func (o *OpenRelay) publishCompressed(room *defs.RoomParameter, relay *defs.RoomInstance, header defs.Header, msg codec.Message) error {
+	content, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	compressed, err := compress(room, content)
+	if err != nil {
+		return err
+	}
+	if compressed == nil {
+		return o.publishMessage(relay, header, &codec.Raw{Data: content})
+	}
+	compressedHeader := header
+	compressedHeader.ContentCode |= room.Compression
+
+	acceptCount := 0
+	for uid := range relay.Identities {
+		if accepts(relay, uid, room.Compression) {
+			acceptCount++
+		}
+	}
+	switch acceptCount {
+	case 0:
+		return o.publishMessage(relay, header, &codec.Raw{Data: content})
+	case len(relay.Identities):
+		return o.publishMessage(relay, compressedHeader, &codec.Raw{Data: compressed})
+	}
+	for uid := range relay.Identities {
+		if accepts(relay, uid, room.Compression) {
+			err = o.sendMessage(relay, uid, compressedHeader, &codec.Raw{Data: compressed})
+		} else {
+			err = o.sendMessage(relay, uid, header, &codec.Raw{Data: content})
+		}
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "send failed. ", err)
+		}
+	}
+	return nil
+}
+
+// sendCompressed sends msg to uid, compressed when uid accepts the room compression.
+func (o *OpenRelay) sendCompressed(room *defs.RoomParameter, relay *defs.RoomInstance, uid defs.PlayerId, header defs.Header, msg codec.Message) error {
+	content, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	if !accepts(relay, uid, room.Compression) {
+		return o.sendMessage(relay, uid, header, &codec.Raw{Data: content})
+	}
+	compressed, err := compress(room, content)
+	if err != nil {
+		return err
+	}
+	if compressed == nil {
+		return o.sendMessage(relay, uid, header, &codec.Raw{Data: content})
+	}
+	header.ContentCode |= room.Compression
+	return o.sendMessage(relay, uid, header, &codec.Raw{Data: compressed})
+}
@@ -19,9 +19,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"openrelay/internal/codec"
 	"openrelay/internal/defs"
 	"strconv"
 	"strings"
@@ -30,14 +32,16 @@ import (
 
 func (o *OpenRelay) EntryServ() {
 	http.HandleFunc("/version", version)
-	http.HandleFunc("/logon", logon)
+	http.HandleFunc("/logon", o.logon)
 	http.HandleFunc("/rooms", o.Rooms)
 	http.HandleFunc("/room/info", o.roomInfo)
 	http.HandleFunc("/room/create/", o.Create)
 	http.HandleFunc("/room/join_prepare_polling/", o.JoinPreparePolling)
 	http.HandleFunc("/room/join_prepare_complete/", o.JoinPrepareComplete)
 	http.HandleFunc("/room/prop/", o.RoomProp)
-	http.HandleFunc("/logoff", logoff)
+	http.HandleFunc("/room/limit/", o.RoomLimit)
+	http.HandleFunc("/room/ws/", o.RoomGateway)
+	http.HandleFunc("/logoff", o.logoff)
 	s := &http.Server{
 		Addr:              o.EntryHost + ":" + o.EntryPort,
 		ReadTimeout:       10 * time.Second,
@@ -74,10 +78,32 @@ func version(w http.ResponseWriter, r *http.Request) {
 	log.Println(defs.VERBOSE, defs.CALLOUT, "version")
 }
 
-func logon(w http.ResponseWriter, r *http.Request) {
+func (o *OpenRelay) logon(w http.ResponseWriter, r *http.Request) {
 	validatePost(w, r)
 	log.Println(defs.VERBOSE, defs.CALLIN, "logon")
-	w.Write([]byte("OK")) //TODO sessid
+	session, err := o.Sessions.Issue()
+	if err == ErrSessionsFull {
+		log.Println(defs.NOTICE, "session issue refused. ", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "logon")
+		return
+	}
+	if err != nil {
+		log.Error("session issue failed. ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "logon")
+		return
+	}
+	writeBuf := new(bytes.Buffer)
+	err = binary.Write(writeBuf, binary.LittleEndian, session)
+	if err != nil {
+		log.Error("binary write failed. ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "logon")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(writeBuf.Bytes())
 	log.Println(defs.VERBOSE, defs.CALLOUT, "logon")
 }
 
@@ -180,16 +206,16 @@ func (o *OpenRelay) Create(w http.ResponseWriter, r *http.Request) {
 		// reserve immediately
 		o.ReserveRooms[requestName] = roomId
 		o.ResolveRoomIds[roomIdHexStr] = requestName
-		body := make([]byte, 2) //uint16 size
-		_, err := r.Body.Read(body)
-		if err != nil && err != io.EOF {
+		body := make([]byte, 6) //uint16 size, optional room policy
+		n, err := io.ReadFull(r.Body, body)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			log.Error("polling failed. ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write(o.getResponseBytes(defs.OPENRELAY_RESPONSE_CODE_NG_REQUEST_READ_FAILED))
 			log.Println(defs.VERBOSE, defs.CALLOUT, "Create")
 			return
 		}
-		readBuf := bytes.NewReader(body)
+		readBuf := bytes.NewReader(body[:n])
 
 		var maxPlayers uint16
 		err = binary.Read(readBuf, binary.LittleEndian, &maxPlayers)
@@ -203,6 +229,31 @@ func (o *OpenRelay) Create(w http.ResponseWriter, r *http.Request) {
 		o.RoomQueue[roomIdHexStr].Name = requestName
 		o.RoomQueue[roomIdHexStr].Filter = ""
 		o.RoomQueue[roomIdHexStr].Capacity = maxPlayers
+		o.RoomQueue[roomIdHexStr].Compression = o.Compression
+		o.RoomQueue[roomIdHexStr].CompressMin = o.CompressMin
+		o.RoomQueue[roomIdHexStr].Authenticate = o.Authenticate
+		o.RoomQueue[roomIdHexStr].Encrypt = false
+		o.RoomQueue[roomIdHexStr].Limits = o.RateLimits
+		// compress(byte) 0=off, 1=deflate, 2=zstd, flags(byte), compressMin(uint16)
+		if readBuf.Len() == 4 {
+			policy := struct {
+				Compress    byte
+				Flags       byte
+				CompressMin uint16
+			}{}
+			err = binary.Read(readBuf, binary.LittleEndian, &policy)
+			if err != nil {
+				log.Error("binary read failed. invalid request data", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(o.getResponseBytes(defs.OPENRELAY_RESPONSE_CODE_NG_REQUEST_READ_FAILED))
+				log.Println(defs.VERBOSE, defs.CALLOUT, "Create")
+				return
+			}
+			o.RoomQueue[roomIdHexStr].Compression = Compression(int(policy.Compress))
+			o.RoomQueue[roomIdHexStr].CompressMin = int(policy.CompressMin)
+			o.RoomQueue[roomIdHexStr].Authenticate = policy.Flags&defs.ROOM_FLAG_AUTHENTICATE != 0
+			o.RoomQueue[roomIdHexStr].Encrypt = policy.Flags&defs.ROOM_FLAG_ENCRYPT != 0
+		}
 
 		writeBuf, err = o.addResponseBytes(writeBuf, defs.OPENRELAY_RESPONSE_CODE_OK_ROOM_ASSGIN_AND_CREATED)
 		if err != nil {
@@ -258,7 +309,16 @@ func (o *OpenRelay) addRoomResponse(writeBuf *bytes.Buffer, relay defs.RoomInsta
 	roomRes.Capacity = room.Capacity
 	roomRes.UserCount = uint16(len(relay.Guids))
 	roomRes.QueuingPolicy = room.QueuingPolicy
-	roomRes.Flags = 0 ^ 7 | 0 ^ 6 | 0 ^ 5 | 0 ^ 4 | 0 ^ 3 | 0 ^ 2 | 0 ^ 1 | 0
+	roomRes.Flags = 0
+	if room.Stealth {
+		roomRes.Flags |= defs.ROOM_RESPONSE_FLAG_STEALTH
+	}
+	if room.UseStateless {
+		roomRes.Flags |= defs.ROOM_RESPONSE_FLAG_STATELESS
+	}
+	if room.Transport == defs.TRANSPORT_TCP {
+		roomRes.Flags |= defs.ROOM_RESPONSE_FLAG_TCP
+	}
 	roomRes.StfDealPort = room.StfDealPort
 	roomRes.StfSubPort = room.StfSubPort
 	roomRes.StlDealPort = room.StlDealPort
@@ -273,19 +333,23 @@ func (o *OpenRelay) addRoomResponse(writeBuf *bytes.Buffer, relay defs.RoomInsta
 		roomRes.Filter = [256]byte{}
 		copy(roomRes.Filter[:roomRes.FilterLen], room.Filter[:roomRes.FilterLen])
 	}
-	roomRes.ListenMode = byte(o.ListenMode)
-	ipv4Addr, err := net.ResolveIPAddr("ip4", o.ListenIpv4)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "addRoomResponse")
-		return nil, err
+	roomRes.ListenMode = byte(o.baseListenMode())
+	if o.listensIpv4() {
+		ipv4Addr, err := net.ResolveIPAddr("ip4", o.ListenIpv4)
+		if err != nil {
+			log.Println(defs.VVERBOSE, defs.CALLOUT, "addRoomResponse")
+			return nil, err
+		}
+		copy(roomRes.ListenAddrIpv4[:], ipv4Addr.IP.To4()[:4])
 	}
-	copy(roomRes.ListenAddrIpv4[:], ipv4Addr.IP.To4()[:4])
-	ipv6Addr, err := net.ResolveIPAddr("ip6", o.ListenIpv6)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "addRoomResponse")
-		return nil, err
+	if o.listensIpv6() {
+		ipv6Addr, err := net.ResolveIPAddr("ip6", o.ListenIpv6)
+		if err != nil {
+			log.Println(defs.VVERBOSE, defs.CALLOUT, "addRoomResponse")
+			return nil, err
+		}
+		copy(roomRes.ListenAddrIpv6[:], ipv6Addr.IP.To16())
 	}
-	copy(roomRes.ListenAddrIpv6[:], ipv6Addr.IP.To16())
 	err = binary.Write(writeBuf, binary.LittleEndian, roomRes)
 	if err != nil {
 		log.Println(defs.VVERBOSE, defs.CALLOUT, "addRoomResponse")
@@ -306,10 +370,8 @@ func (o *OpenRelay) addRoomResponse(writeBuf *bytes.Buffer, relay defs.RoomInsta
 	log.Printf(defs.VERBOSE, "response room filter length :%d", roomRes.FilterLen)
 	log.Printf(defs.VERBOSE, "response room listen mode :%d", roomRes.ListenMode)
 	log.Printf(defs.VERBOSE, "response room listen addr ipv4(origin) :%s", o.ListenIpv4)
-	log.Printf(defs.VERBOSE, "response room listen addr ipv4(resolve addr) :%s", ipv4Addr.IP.String())
 	log.Printf(defs.VERBOSE, "response room listen addr ipv4(parsed) :%x", roomRes.ListenAddrIpv4)
 	log.Printf(defs.VERBOSE, "response room listen addr ipv6(origin) :%s", o.ListenIpv6)
-	log.Printf(defs.VERBOSE, "response room listen addr ipv6(resolve addr) :%s", ipv6Addr.IP.String())
 	log.Printf(defs.VERBOSE, "response room listen addr ipv6(parsed) :%x", roomRes.ListenAddrIpv6)
 
 	log.Println(defs.VVERBOSE, defs.CALLOUT, "addRoomResponse")
@@ -405,7 +467,7 @@ func (o *OpenRelay) JoinPreparePolling(w http.ResponseWriter, r *http.Request) {
 
 	if joinProcessQueue.Seed == "" {
 		if len(joinPollingQueue) == 0 {
-			res, err := o.JoinPrepareResponse(relay, joinSeed)
+			res, err := o.JoinPrepareResponse(room, relay, joinSeed)
 			if err != nil {
 				log.Println(defs.NOTICE, "polling failed. ", err)
 				w.WriteHeader(http.StatusBadRequest)
@@ -421,7 +483,7 @@ func (o *OpenRelay) JoinPreparePolling(w http.ResponseWriter, r *http.Request) {
 			log.Println(defs.VERBOSE, defs.CALLOUT, "JoinPreparePolling")
 			return
 		} else if check := hex.EncodeToString(joinPollingQueue[0]); check == hexJoinSeed {
-			res, err := o.JoinPrepareResponse(relay, joinSeed)
+			res, err := o.JoinPrepareResponse(room, relay, joinSeed)
 			if err != nil {
 				log.Println(defs.NOTICE, "polling failed. ", err)
 				w.WriteHeader(http.StatusBadRequest)
@@ -512,10 +574,42 @@ func (o *OpenRelay) readJoinSeed(readBuf *bytes.Reader) ([]byte, error) {
 	return joinSeed, nil
 }
 
-func (o *OpenRelay) JoinPrepareResponse(relay *defs.RoomInstance, joinSeed []byte) ([]byte, error) {
+// JoinPrepareResponse assigns a uid to joinSeed in the relay loop, and waits for the response content.
+func (o *OpenRelay) JoinPrepareResponse(room *defs.RoomParameter, relay *defs.RoomInstance, joinSeed []byte) ([]byte, error) {
 	log.Println(defs.VVERBOSE, defs.CALLIN, "JoinPrepareResponse")
-	var err error
-	writeBuf := new(bytes.Buffer)
+	if relay.Done == nil {
+		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
+		return nil, errors.New("room relay is not started, join refused")
+	}
+	type result struct {
+		content []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	post(relay, func() {
+		content, err := o.joinPrepare(room, relay, joinSeed)
+		done <- result{content, err}
+	})
+	select {
+	case res := <-done:
+		if res.err != nil {
+			log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
+			return nil, res.err
+		}
+		log.Println(defs.VERBOSE, defs.CALLOUT, "JoinPrepareResponse")
+		return res.content, nil
+	case <-relay.Done:
+		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
+		return nil, errors.New("room relay is stopped, join refused")
+	}
+}
+
+// joinPrepare runs in the relay loop, the maps of relay are written by the loop only.
+func (o *OpenRelay) joinPrepare(room *defs.RoomParameter, relay *defs.RoomInstance, joinSeed []byte) ([]byte, error) {
+	roomKey := relay.RoomKey.Get()
+	if (room.Encrypt || room.UseStateless || 0 < o.RejoinGrace) && len(roomKey) == 0 {
+		return nil, errors.New("room key is not created, join refused")
+	}
 	relay.LastUid += 1
 	if relay.MasterUidNeed {
 		relay.MasterUidNeed = false
@@ -528,79 +622,24 @@ func (o *OpenRelay) JoinPrepareResponse(relay *defs.RoomInstance, joinSeed []byt
 	assginUid := relay.LastUid
 	relay.Guids[string(joinSeed)] = relay.LastUid
 	relay.Uids[relay.LastUid] = string(joinSeed)
-	joinedUidsLen := uint16(len(joinedUids))
-	joinedNamesLen := uint16(len(relay.Names))
-	alignmentLen := uint16(0)
-	alignment := []byte{}
+	names := [][]byte{}
+	for _, name := range relay.Names {
+		names = append(names, []byte(name))
+	}
 	relay.Hbs[assginUid] = time.Now().Unix()
 	log.Println(defs.INFO, ">> join request ", relay.LastUid, ", seed ", hex.EncodeToString(joinSeed))
 
-	err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-		return nil, err
-	}
-	err = binary.Write(writeBuf, binary.LittleEndian, assginUid)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-		return nil, err
-	}
-	err = binary.Write(writeBuf, binary.LittleEndian, joinedUidsLen)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-		return nil, err
-	}
-
-	err = binary.Write(writeBuf, binary.LittleEndian, joinedNamesLen)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-		return nil, err
+	res := &codec.JoinPrepare{MasterUid: relay.MasterUid, AssignUid: assginUid, JoinedUids: joinedUids, Names: names}
+	if room.Encrypt {
+		res.RoomKey = roomKey
 	}
-
-	err = binary.Write(writeBuf, binary.LittleEndian, joinedUids)
-	if err != nil {
-		log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-		return nil, err
+	if room.UseStateless {
+		res.StatelessKey = codec.StatelessKey(roomKey, joinSeed)
 	}
-	//write adjust alignment at joinedUidsLen.
-	alignmentLen = joinedUidsLen % 4
-	if alignmentLen != 0 {
-		alignment = make([]byte, alignmentLen)
-		err = binary.Write(writeBuf, binary.LittleEndian, alignment)
-		if err != nil {
-			log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-			return nil, err
-		}
-	}
-
-	for _, name := range relay.Names {
-		nameBytes := []byte(name)
-		nameLen := uint16(len(name))
-
-		err = binary.Write(writeBuf, binary.LittleEndian, nameLen)
-		if err != nil {
-			log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-			return nil, err
-		}
-
-		err = binary.Write(writeBuf, binary.LittleEndian, nameBytes)
-		if err != nil {
-			log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-			return nil, err
-		}
-		//write adjust alignment at nameLen.
-		alignmentLen = (2 + nameLen) % 4
-		if alignmentLen != 0 {
-			alignment = make([]byte, alignmentLen)
-			err = binary.Write(writeBuf, binary.LittleEndian, alignment)
-			if err != nil {
-				log.Println(defs.VVERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-				return nil, err
-			}
-		}
+	if 0 < o.RejoinGrace {
+		res.RejoinToken = codec.RejoinToken(roomKey, joinSeed)
 	}
-	log.Println(defs.VERBOSE, defs.CALLOUT, "JoinPrepareResponse")
-	return writeBuf.Bytes(), nil
+	return res.Marshal()
 }
 
 func (o *OpenRelay) RoomProp(w http.ResponseWriter, r *http.Request) {
@@ -646,6 +685,64 @@ func (o *OpenRelay) RoomProp(w http.ResponseWriter, r *http.Request) {
 	log.Println(defs.VERBOSE, defs.CALLOUT, "RoomProp")
 }
 
+// RoomLimit overrides rate limits of a room, { class(byte), alignment(byte), msgs(uint16), bytes(uint32) }...
+// msgs and bytes are per second for each player, 0=unlimited.
+func (o *OpenRelay) RoomLimit(w http.ResponseWriter, r *http.Request) {
+	if !validatePut(w, r) {
+		return
+	}
+	log.Println(defs.VERBOSE, defs.CALLIN, "RoomLimit")
+	requestName := strings.Replace(r.URL.Path, "/room/limit/", "", 1)
+	roomId, exist := o.ReserveRooms[requestName]
+	if !exist {
+		log.Println(defs.NOTICE, "room not found.")
+		w.WriteHeader(http.StatusNotFound)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "RoomLimit")
+		return
+	}
+	roomIdHexStr := defs.GuidFormatString(roomId)
+	room := o.RoomQueue[roomIdHexStr]
+	relay := o.RelayQueue[roomIdHexStr]
+	if relay.Done == nil {
+		log.Println(defs.NOTICE, "room relay is not started.")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "RoomLimit")
+		return
+	}
+	limits := map[defs.CodeClass]defs.RateLimit{}
+	for {
+		limit := struct {
+			Class defs.CodeClass
+			_     byte
+			Msgs  uint16
+			Bytes uint32
+		}{}
+		err := binary.Read(r.Body, binary.LittleEndian, &limit)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || defs.CLASS_COUNT <= limit.Class {
+			log.Error("binary read failed. invalid request data", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(o.getResponseBytes(defs.OPENRELAY_RESPONSE_CODE_NG_REQUEST_READ_FAILED))
+			log.Println(defs.VERBOSE, defs.CALLOUT, "RoomLimit")
+			return
+		}
+		limits[limit.Class] = defs.RateLimit{Msgs: int(limit.Msgs), Bytes: int(limit.Bytes)}
+	}
+	// limits are read by the relay loop, so they are applied there.
+	post(relay, func() {
+		for class, limit := range limits {
+			room.Limits[class] = limit
+		}
+		relay.Log.Printf(defs.INFO, "room limits %v", room.Limits)
+	})
+	log.Printf(defs.INFO, "room %s limits %v", requestName, limits)
+	w.WriteHeader(http.StatusOK)
+	w.Write(o.getResponseBytes(defs.OPENRELAY_RESPONSE_CODE_OK))
+	log.Println(defs.VERBOSE, defs.CALLOUT, "RoomLimit")
+}
+
 func (o *OpenRelay) JoinPrepareComplete(w http.ResponseWriter, r *http.Request) {
 	validatePost(w, r)
 	log.Println(defs.VERBOSE, defs.CALLIN, "JoinPrepareComplete")
@@ -703,9 +800,14 @@ func (o *OpenRelay) JoinPrepareComplete(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func logoff(w http.ResponseWriter, r *http.Request) {
+func (o *OpenRelay) logoff(w http.ResponseWriter, r *http.Request) {
 	validatePost(w, r)
 	log.Println(defs.VERBOSE, defs.CALLIN, "logoff")
+	sessionId := [codec.SessionIdSize]byte{}
+	_, err := io.ReadFull(r.Body, sessionId[:])
+	if err == nil {
+		o.Sessions.Revoke(sessionId)
+	}
 	w.Write([]byte("OK"))
 	log.Println(defs.VERBOSE, defs.CALLOUT, "logoff")
 }
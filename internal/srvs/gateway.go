@@ -0,0 +1,121 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"openrelay/internal/defs"
+	"strings"
+	"time"
+)
+
+const gatewayWriteTimeout = 10 * time.Second
+
+// RoomGateway upgrades /room/ws/<name> to a websocket peer of the room for browsers,
+// binary messages carry the same frames as the zeromq path, one frame per message.
+func (o *OpenRelay) RoomGateway(w http.ResponseWriter, r *http.Request) {
+	if !validateGet(w, r) {
+		return
+	}
+	log.Println(defs.VERBOSE, defs.CALLIN, "RoomGateway")
+	requestName := strings.Replace(r.URL.Path, "/room/ws/", "", 1)
+	roomId, exist := o.ReserveRooms[requestName]
+	if !exist {
+		log.Println(defs.NOTICE, "room not found.")
+		w.WriteHeader(http.StatusNotFound)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "RoomGateway")
+		return
+	}
+	relay := o.RelayQueue[defs.GuidFormatString(roomId)]
+	if relay.Gateway == nil || relay.Inbox == nil {
+		log.Println(defs.NOTICE, "room relay is not started.")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "RoomGateway")
+		return
+	}
+	upgrader := websocket.Upgrader{}
+	if o.WsOrigins != "" {
+		upgrader.CheckOrigin = o.checkOrigin
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("websocket upgrade failed. ", err)
+		log.Println(defs.VERBOSE, defs.CALLOUT, "RoomGateway")
+		return
+	}
+	log.Println(defs.VERBOSE, defs.CALLOUT, "RoomGateway")
+	o.serveGateway(relay, conn)
+}
+
+// checkOrigin allows origins listed in -wsorigins, * allows every origin.
+func (o *OpenRelay) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(o.WsOrigins, ",") {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGateway bridges messages of conn into the relay loop until conn is closed,
+// replies and publications are written back by gatewayWriteLoop.
+func (o *OpenRelay) serveGateway(relay *defs.RoomInstance, conn *websocket.Conn) {
+	identity, queue := relay.Gateway.Add()
+	defer relay.Gateway.Remove(identity)
+	go gatewayWriteLoop(relay, conn, identity, queue)
+
+	relay.Log.Println(defs.VERBOSE, "websocket connected. ", string(identity), conn.RemoteAddr())
+	conn.SetReadLimit(int64(o.tcpFrameMax()))
+	for {
+		// deadlines of the entry server are left on the hijacked connection.
+		deadline := time.Time{}
+		if 0 < o.HeatbeatTimeout {
+			deadline = time.Now().Add(time.Duration(o.HeatbeatTimeout) * time.Second)
+		}
+		conn.SetReadDeadline(deadline)
+		messageType, frame, err := conn.ReadMessage()
+		if err != nil {
+			relay.Log.Println(defs.VERBOSE, "websocket closed. ", string(identity), err)
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			relay.Log.Println(defs.NOTICE, "websocket text message dropped. ", string(identity))
+			continue
+		}
+		select {
+		case relay.Inbox <- [][]byte{identity, frame}:
+		case <-relay.Done:
+			return
+		}
+	}
+}
+
+func gatewayWriteLoop(relay *defs.RoomInstance, conn *websocket.Conn, identity []byte, queue <-chan []byte) {
+	defer conn.Close()
+	for frame := range queue {
+		conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+		err := conn.WriteMessage(websocket.BinaryMessage, frame)
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "websocket send failed. ", string(identity), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"fmt"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+)
+
+// RelayHandler serves a user defined relay code inside the relay loop of the room.
+// the frame is dropped unless the handler replies or broadcasts through ctx.
+type RelayHandler func(ctx *HandlerContext, content []byte) error
+
+type HandlerContext struct {
+	Relay    *defs.RoomInstance
+	Header   defs.Header
+	DestUids []defs.PlayerId
+	o        *OpenRelay
+}
+
+// RegisterHandler sets handler for code, code must be in the user define range.
+// handlers must be registered before ServiceInit.
+func (o *OpenRelay) RegisterHandler(code defs.RelayCode, handler RelayHandler) error {
+	if code < defs.USER_DEFINE_RELAY_CODE_MIN {
+		return fmt.Errorf("relay code %d is not user define relay code", code)
+	}
+	o.Handlers[code] = handler
+	return nil
+}
+
+// Reply sends content to the sender with the received header.
+func (c *HandlerContext) Reply(content []byte) error {
+	frame, err := c.frame(content)
+	if err != nil {
+		return err
+	}
+	return c.o.sendTo(c.Relay, c.Header.SrcUid, frame)
+}
+
+// Broadcast publishes content to the room with the received header.
+func (c *HandlerContext) Broadcast(content []byte) error {
+	frame, err := c.frame(content)
+	if err != nil {
+		return err
+	}
+	return c.o.publish(c.Relay, frame)
+}
+
+func (c *HandlerContext) frame(content []byte) ([]byte, error) {
+	return codec.EncodeFrame(c.Header, nil, &codec.Raw{Data: content})
+}
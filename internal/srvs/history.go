@@ -0,0 +1,87 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+)
+
+// resendMax is the most frames answered to one RESEND.
+const resendMax = 32
+
+// sequence stamps the next room sequence on a published frame,
+// reliable frames are kept in the room history until HistoryMax newer ones are sent.
+// only frames published to the whole room are sequenced, so that every player sees every sequence
+// and a gap always means a lost frame.
+func (o *OpenRelay) sequence(relay *defs.RoomInstance, frame []byte) []byte {
+	header, err := codec.PeekHeader(frame)
+	if err != nil {
+		return frame
+	}
+	relay.Seq++
+	if relay.Seq == 0 {
+		relay.Seq = 1
+	}
+	stamped, err := codec.SetSeq(frame, relay.Seq)
+	if err != nil {
+		return frame
+	}
+	if header.ContentCode&defs.CONTENT_RELIABLE == 0 || o.HistoryMax <= 0 {
+		return stamped
+	}
+	relay.History = append(relay.History, defs.SentFrame{Seq: relay.Seq, Mask: header.Mask, Frame: stamped})
+	if over := len(relay.History) - o.HistoryMax; 0 < over {
+		relay.History = relay.History[over:]
+	}
+	return stamped
+}
+
+// unsequenced reports whether a relay frame asks for reliability but is not published to the whole room,
+// point to point and masked frames carry no sequence and cannot be resent.
+func (o *OpenRelay) unsequenced(header defs.Header) bool {
+	if header.ContentCode&defs.CONTENT_RELIABLE == 0 || o.HistoryMax <= 0 {
+		return false
+	}
+	return (header.DestCode != defs.OTHERS && header.DestCode != defs.ALL) || header.Mask != 0
+}
+
+// resend sends uid the kept frames from FromSeq to ToSeq, frames no longer kept are skipped.
+// at most resendMax frames are sent, ToSeq is narrowed to the last sent one so that the rest is requested again.
+func (o *OpenRelay) resend(relay *defs.RoomInstance, uid defs.PlayerId, resend *codec.Resend) int {
+	count := 0
+	lastSeq := resend.FromSeq
+	for _, sent := range relay.History {
+		if resend.ToSeq-resend.FromSeq < sent.Seq-resend.FromSeq {
+			continue
+		}
+		if !subscribes(relay, uid, sent.Mask) {
+			continue
+		}
+		if count == resendMax {
+			resend.ToSeq = lastSeq
+			return count
+		}
+		err := o.sendTo(relay, uid, sent.Frame)
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "resend failed. ", err)
+			return count
+		}
+		lastSeq = sent.Seq
+		count++
+	}
+	return count
+}
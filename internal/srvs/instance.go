@@ -34,6 +34,9 @@ type OpenRelay struct {
 	StlSubHost           string
 	StlSubProto          string
 	StlSubPorts          string
+	UseStateless         bool
+	Transports           string
+	WsOrigins            string
 	AdminHost            string
 	AdminPort            string
 	ListenIpv4           string
@@ -44,7 +47,23 @@ type OpenRelay struct {
 	RecMode              int
 	RepMode              bool
 	HeatbeatTimeout      int
+	RejoinGrace          int
 	JoinTimeout          int
+	StackMax             int
+	StreamMax            int
+	ContentMax           int
+	HistoryMax           int
+	PropMax              int
+	PropValueMax         int
+	MinFrameVersion      byte
+	Compression          byte
+	CompressMin          int
+	Authenticate         bool
+	Sessions             *Sessions
+	RateLimits           [defs.CLASS_COUNT]defs.RateLimit
+	KickStrikes          int
+	PlayerStore          PlayerStore
+	Handlers             map[defs.RelayCode]RelayHandler
 	JoinAllPollingQueue  map[string][][]byte
 	JoinAllProcessQueue  map[string]defs.RoomJoinRequest
 	JoinAllTimeoutQueue  map[string][]defs.RoomJoinRequest
@@ -62,12 +81,17 @@ func NewOpenRelay(eHost string, ePort string,
 	sfdHost string, sfdProto string, sfdPorts string,
 	sfsHost string, sfsProto string, sfsPorts string,
 	sldHost string, sldProto string, sldPorts string,
-	slsHost string, slsProto string, slsPorts string,
+	slsHost string, slsProto string, slsPorts string, useStateless bool,
+	transports string, wsOrigins string,
 	aHost string, aPort string,
 	listenIpv4 string, listenIpv6 string,
 	listenMode int, logLevel int, logDir string,
 	recMode int, repMode bool,
-	heatbeatTimeout int, joinTimeout int) *OpenRelay {
+	heatbeatTimeout int, rejoinGrace int, joinTimeout int,
+	stackMax int, streamMax int, contentMax int, historyMax int, minFrameVersion int,
+	propMax int, propValueMax int,
+	compress int, compressMin int, authenticate bool, sessionTtl int, sessionMax int,
+	rateLimits [defs.CLASS_COUNT]defs.RateLimit, kickStrikes int, playerDir string) *OpenRelay {
 	return &OpenRelay{
 		EntryHost:            eHost,
 		EntryPort:            ePort,
@@ -83,6 +107,9 @@ func NewOpenRelay(eHost string, ePort string,
 		StlSubHost:           slsHost,
 		StlSubProto:          slsProto,
 		StlSubPorts:          slsPorts,
+		UseStateless:         useStateless,
+		Transports:           transports,
+		WsOrigins:            wsOrigins,
 		AdminHost:            aHost,
 		AdminPort:            aPort,
 		ListenIpv4:           listenIpv4,
@@ -93,7 +120,23 @@ func NewOpenRelay(eHost string, ePort string,
 		RecMode:              recMode,
 		RepMode:              repMode,
 		HeatbeatTimeout:      heatbeatTimeout,
+		RejoinGrace:          rejoinGrace,
 		JoinTimeout:          joinTimeout,
+		StackMax:             stackMax,
+		StreamMax:            streamMax,
+		ContentMax:           contentMax,
+		HistoryMax:           historyMax,
+		PropMax:              propMax,
+		PropValueMax:         propValueMax,
+		MinFrameVersion:      byte(minFrameVersion),
+		Compression:          Compression(compress),
+		CompressMin:          compressMin,
+		Authenticate:         authenticate,
+		Sessions:             NewSessions(sessionTtl, sessionMax),
+		RateLimits:           rateLimits,
+		KickStrikes:          kickStrikes,
+		PlayerStore:          NewFilePlayerStore(playerDir),
+		Handlers:             make(map[defs.RelayCode]RelayHandler, 0),
 		JoinAllPollingQueue:  make(map[string][][]byte, 0),
 		JoinAllProcessQueue:  make(map[string]defs.RoomJoinRequest),
 		JoinAllTimeoutQueue:  make(map[string][]defs.RoomJoinRequest, 0),
@@ -0,0 +1,162 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"fmt"
+	"math"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// strikes older than strikeWindow are forgotten.
+const strikeWindow = 10 * time.Second
+
+var classNames = map[string]defs.CodeClass{
+	"control": defs.CLASS_CONTROL,
+	"relay":   defs.CLASS_RELAY,
+	"latest":  defs.CLASS_LATEST,
+	"prop":    defs.CLASS_PROP,
+	"request": defs.CLASS_REQUEST,
+	"user":    defs.CLASS_USER,
+}
+
+// ParseRateLimits parses "class:msgs:bytes" separated by comma, e.g. "relay:60:65536,request:20:16384".
+// classes not listed are unlimited.
+func ParseRateLimits(limits string) ([defs.CLASS_COUNT]defs.RateLimit, error) {
+	parsed := [defs.CLASS_COUNT]defs.RateLimit{}
+	for _, entry := range strings.Split(limits, ",") {
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 {
+			return parsed, fmt.Errorf("invalid rate limit '%s'", entry)
+		}
+		class, ok := classNames[fields[0]]
+		if !ok {
+			return parsed, fmt.Errorf("invalid rate limit class '%s'", fields[0])
+		}
+		msgs, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return parsed, err
+		}
+		bytes, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return parsed, err
+		}
+		parsed[class] = defs.RateLimit{Msgs: msgs, Bytes: bytes}
+	}
+	return parsed, nil
+}
+
+func codeClass(code defs.RelayCode) defs.CodeClass {
+	switch code {
+	case defs.RELAY, defs.RELAY_STREAM, defs.UNITY_CDK_RELAY, defs.UE4_CDK_RELAY, defs.PUSH_STACK:
+		return defs.CLASS_RELAY
+	case defs.RELAY_LATEST, defs.UNITY_CDK_RELAY_LATEST, defs.UE4_CDK_RELAY_LATEST:
+		return defs.CLASS_LATEST
+	case defs.SET_LEGACY_MAP, defs.SET_LOBBY_MAP, defs.SET_SHARE_PROP, defs.DELETE_SHARE_PROP, defs.SET_MASTER, defs.SET_MASK:
+		return defs.CLASS_PROP
+	case defs.GET_LEGACY_MAP, defs.GET_USERS, defs.GET_MASTER, defs.GET_SERVER_TIMESTAMP, defs.GET_LATEST,
+		defs.UNITY_CDK_GET_LATEST, defs.UE4_CDK_GET_LATEST, defs.GET_LOBBY_MAP, defs.GET_MASK,
+		defs.FETCH_STACK, defs.LOAD_PLAYER, defs.GET_SHARE_PROP, defs.RESEND:
+		return defs.CLASS_REQUEST
+	}
+	if defs.USER_DEFINE_RELAY_CODE_MIN <= code {
+		return defs.CLASS_USER
+	}
+	return defs.CLASS_CONTROL
+}
+
+// take refills bucket by elapsed time and takes a frame of size bytes.
+// bytes may go into debt so that a frame larger than one second of budget still passes once.
+func take(bucket *defs.Bucket, limit defs.RateLimit, size int, now int64) bool {
+	if bucket.Last == 0 {
+		bucket.Msgs = float64(limit.Msgs)
+		bucket.Bytes = float64(limit.Bytes)
+	} else {
+		elapsed := float64(now-bucket.Last) / float64(time.Second)
+		bucket.Msgs = math.Min(float64(limit.Msgs), bucket.Msgs+elapsed*float64(limit.Msgs))
+		bucket.Bytes = math.Min(float64(limit.Bytes), bucket.Bytes+elapsed*float64(limit.Bytes))
+	}
+	bucket.Last = now
+	if 0 < limit.Msgs && bucket.Msgs < 1 {
+		return false
+	}
+	if 0 < limit.Bytes && bucket.Bytes <= 0 {
+		return false
+	}
+	bucket.Msgs--
+	bucket.Bytes -= float64(size)
+	return true
+}
+
+// allow reports whether a frame of size bytes from a joined player is within the room limits.
+func allow(room *defs.RoomParameter, relay *defs.RoomInstance, header defs.Header, size int) bool {
+	if _, ok := relay.Identities[header.SrcUid]; !ok {
+		return true
+	}
+	class := codeClass(header.RelayCode)
+	limit := room.Limits[class]
+	if limit.Msgs <= 0 && limit.Bytes <= 0 {
+		return true
+	}
+	rate, ok := relay.Rates[header.SrcUid]
+	if !ok {
+		rate = &defs.PlayerRate{}
+		relay.Rates[header.SrcUid] = rate
+	}
+	return take(&rate.Buckets[class], limit, size, time.Now().UnixNano())
+}
+
+// throttle counts a dropped frame, notices the sender at most once a second,
+// and kicks the player after KickStrikes drops within strikeWindow.
+func (o *OpenRelay) throttle(room *defs.RoomParameter, relay *defs.RoomInstance, header defs.Header) {
+	uid := header.SrcUid
+	rate := relay.Rates[uid]
+	now := time.Now().UnixNano()
+	if int64(strikeWindow) < now-rate.LastOver {
+		rate.Strikes = 0
+	}
+	rate.Strikes++
+	rate.LastOver = now
+	relay.Log.Printf(defs.VERBOSE, "throttled uid:%d code:%d strikes:%d", uid, header.RelayCode, rate.Strikes)
+
+	if 0 < o.KickStrikes && o.KickStrikes <= rate.Strikes {
+		relay.Log.Printf(defs.INFO, "-> kick flooding uid:%d strikes:%d", uid, rate.Strikes)
+		o.forceLeave(relay, room.Id, uid)
+		return
+	}
+	if now-rate.LastNotice < int64(time.Second) {
+		return
+	}
+	rate.LastNotice = now
+	strikes := rate.Strikes
+	if math.MaxUint16 < strikes {
+		strikes = math.MaxUint16
+	}
+	notice := codec.Throttle{RelayCode: header.RelayCode, Class: codeClass(header.RelayCode), Strikes: uint16(strikes)}
+	header.RelayCode = defs.THROTTLE
+	header.ContentCode = 0
+	err := o.sendMessage(relay, uid, header, &notice)
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+	}
+}
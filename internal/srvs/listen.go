@@ -0,0 +1,176 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"net"
+	"openrelay/internal/defs"
+	"strconv"
+	"strings"
+)
+
+// baseListenMode is the mode answered to clients, auto modes are answered as their base mode.
+func (o *OpenRelay) baseListenMode() int {
+	switch o.ListenMode {
+	case defs.LISTEN_MODE_BOTH_AUTO:
+		return defs.LISTEN_MODE_BOTH
+	case defs.LISTEN_MODE_IPV6_AUTO:
+		return defs.LISTEN_MODE_IPV6
+	case defs.LISTEN_MODE_IPV4_AUTO:
+		return defs.LISTEN_MODE_IPV4
+	}
+	return o.ListenMode
+}
+
+func (o *OpenRelay) listensIpv4() bool {
+	mode := o.baseListenMode()
+	return mode == defs.LISTEN_MODE_LOCALNET || mode == defs.LISTEN_MODE_BOTH || mode == defs.LISTEN_MODE_IPV4
+}
+
+func (o *OpenRelay) listensIpv6() bool {
+	mode := o.baseListenMode()
+	return mode == defs.LISTEN_MODE_BOTH || mode == defs.LISTEN_MODE_IPV6
+}
+
+// bindHost resolves a listen host by the listen mode,
+// localnet binds loopback only, * binds every address of the mode families.
+func (o *OpenRelay) bindHost(host string) string {
+	switch o.baseListenMode() {
+	case defs.LISTEN_MODE_LOCALNET:
+		return "127.0.0.1"
+	case defs.LISTEN_MODE_IPV4:
+		if host == "*" {
+			return "0.0.0.0"
+		}
+	case defs.LISTEN_MODE_IPV6:
+		if host == "*" {
+			return "::"
+		}
+	}
+	return host
+}
+
+// bindNetwork narrows a go network such as tcp or udp to the mode family, explicit tcp4 or udp6 are kept.
+func (o *OpenRelay) bindNetwork(proto string) string {
+	if proto != "tcp" && proto != "udp" {
+		return proto
+	}
+	switch o.baseListenMode() {
+	case defs.LISTEN_MODE_LOCALNET, defs.LISTEN_MODE_IPV4:
+		return proto + "4"
+	case defs.LISTEN_MODE_IPV6:
+		return proto + "6"
+	}
+	return proto
+}
+
+// zmqEndpoint builds a zeromq endpoint, ipv6 hosts are bracketed.
+func (o *OpenRelay) zmqEndpoint(proto string, host string, port uint16) string {
+	host = o.zmqHost(host)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return proto + "://" + host + ":" + strconv.Itoa(int(port))
+}
+
+// zmqHost resolves a zeromq bind host. libzmq has no v6 only option and binds :: to ipv4 too,
+// so ipv6 only modes bind * to ListenIpv6 instead, empty when ListenIpv6 is not an ipv6 addr.
+func (o *OpenRelay) zmqHost(host string) string {
+	if o.baseListenMode() != defs.LISTEN_MODE_IPV6 || host != "*" {
+		return o.bindHost(host)
+	}
+	ip := net.ParseIP(o.ListenIpv6)
+	if ip == nil || ip.To4() != nil || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
+
+// bindAddr builds a go listen address, * means every address.
+func (o *OpenRelay) bindAddr(host string, port uint16) string {
+	host = o.bindHost(host)
+	if host == "*" {
+		host = ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// detectListenAddrs fills ListenIpv4 and ListenIpv6 with global addresses of the host interfaces on auto modes,
+// public addresses are preferred over private ones, configured addresses are kept when none is found.
+func (o *OpenRelay) detectListenAddrs() {
+	switch o.ListenMode {
+	case defs.LISTEN_MODE_BOTH_AUTO, defs.LISTEN_MODE_IPV6_AUTO, defs.LISTEN_MODE_IPV4_AUTO:
+	default:
+		return
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println(defs.NOTICE, "interface addrs detect failed. ", err)
+		return
+	}
+	var ipv4, ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.To4() != nil {
+			if ipv4 == nil || (privateIP(ipv4) && !privateIP(ip)) {
+				ipv4 = ip
+			}
+			continue
+		}
+		if ipv6 == nil || (privateIP(ipv6) && !privateIP(ip)) {
+			ipv6 = ip
+		}
+	}
+	if o.listensIpv4() {
+		if ipv4 == nil {
+			log.Println(defs.NOTICE, "global ipv4 addr is not found, keep ", o.ListenIpv4)
+		} else {
+			o.ListenIpv4 = ipv4.String()
+		}
+	}
+	if o.listensIpv6() {
+		if ipv6 == nil {
+			log.Println(defs.NOTICE, "global ipv6 addr is not found, keep ", o.ListenIpv6)
+		} else {
+			o.ListenIpv6 = ipv6.String()
+		}
+	}
+	log.Printf(defs.INFO, "detected listen addr ipv4:%s ipv6:%s", o.ListenIpv4, o.ListenIpv6)
+}
+
+var privateNets = []net.IPNet{
+	{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+	{IP: net.IP{172, 16, 0, 0}, Mask: net.CIDRMask(12, 32)},
+	{IP: net.IP{192, 168, 0, 0}, Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// privateIP reports whether ip is of rfc 1918 or rfc 4193 ranges.
+func privateIP(ip net.IP) bool {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	for _, private := range privateNets {
+		if private.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"net"
+	"openrelay/internal/defs"
+	"testing"
+)
+
+func TestZmqHost(t *testing.T) {
+	tests := []struct {
+		mode       int
+		listenIpv6 string
+		host       string
+		want       string
+	}{
+		{defs.LISTEN_MODE_IPV4, "", "*", "0.0.0.0"},
+		{defs.LISTEN_MODE_BOTH, "", "*", "*"},
+		{defs.LISTEN_MODE_IPV6, "2001:db8::1", "*", "2001:db8::1"},
+		{defs.LISTEN_MODE_IPV6_AUTO, "2001:db8::1", "*", "2001:db8::1"},
+		{defs.LISTEN_MODE_IPV6, "2001:db8::1", "2001:db8::2", "2001:db8::2"},
+		{defs.LISTEN_MODE_IPV6, "localhost", "*", ""},
+		{defs.LISTEN_MODE_IPV6, "192.0.2.1", "*", ""},
+		{defs.LISTEN_MODE_IPV6, "::", "*", ""},
+	}
+	for _, test := range tests {
+		o := &OpenRelay{ListenMode: test.mode, ListenIpv6: test.listenIpv6}
+		got := o.zmqHost(test.host)
+		if got != test.want {
+			t.Errorf("mode %d ipv6 %s host %s bound %q, want %q", test.mode, test.listenIpv6, test.host, got, test.want)
+		}
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"203.0.113.1", false},
+		{"fd00::1", true},
+		{"2001:db8::1", false},
+	}
+	for _, test := range tests {
+		got := privateIP(net.ParseIP(test.ip))
+		if got != test.want {
+			t.Errorf("%s private %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
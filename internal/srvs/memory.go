@@ -0,0 +1,121 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrTransportClosed = errors.New("transport is closed")
+
+// MemTransport is an in-memory transport, peers are channels instead of sockets.
+// set it to RoomInstance.Transport before RelayServ to drive a room without network,
+// RelayServ merges the room inbox into it.
+type MemTransport struct {
+	mutex     sync.RWMutex
+	requests  chan [][]byte
+	inbox     <-chan [][]byte
+	peers     map[string]chan []byte
+	subs      []chan []byte
+	queueSize int
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func NewMemTransport(queueSize int) *MemTransport {
+	return &MemTransport{
+		requests:  make(chan [][]byte, queueSize),
+		peers:     make(map[string]chan []byte),
+		subs:      make([]chan []byte, 0),
+		queueSize: queueSize,
+		closed:    make(chan struct{}),
+	}
+}
+
+// Connect registers identity as a peer, and returns the channel of frames sent to it.
+func (t *MemTransport) Connect(identity []byte) <-chan []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	peer := make(chan []byte, t.queueSize)
+	t.peers[string(identity)] = peer
+	return peer
+}
+
+// Subscribe returns a channel of published frames.
+func (t *MemTransport) Subscribe() <-chan []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	sub := make(chan []byte, t.queueSize)
+	t.subs = append(t.subs, sub)
+	return sub
+}
+
+// Request queues frame as sent by identity.
+func (t *MemTransport) Request(identity []byte, frame []byte) error {
+	select {
+	case t.requests <- [][]byte{identity, frame}:
+		return nil
+	case <-t.closed:
+		return ErrTransportClosed
+	}
+}
+
+func (t *MemTransport) Recv() ([][]byte, error) {
+	select {
+	case request := <-t.requests:
+		return request, nil
+	case request := <-t.inbox:
+		return request, nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (t *MemTransport) Send(identity []byte, frame []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	peer, ok := t.peers[string(identity)]
+	if !ok {
+		return fmt.Errorf("peer not found, identity %s", identity)
+	}
+	select {
+	case peer <- frame:
+		return nil
+	default:
+		return fmt.Errorf("peer queue is full, identity %s", identity)
+	}
+}
+
+// Publish drops frame for subscribers queueSize frames behind.
+func (t *MemTransport) Publish(frame []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, sub := range t.subs {
+		select {
+		case sub <- frame:
+		default:
+		}
+	}
+	return nil
+}
+
+func (t *MemTransport) Close() {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+}
@@ -0,0 +1,121 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// loadMax is the number of LOAD_PLAYER requests of a room waiting the player store at a time.
+const loadMax = 8
+
+// ErrProfileTooLarge is returned by stores for profiles over one frame content.
+var ErrProfileTooLarge = errors.New("player profile is too large")
+
+// PlayerStore loads saved player profiles for LOAD_PLAYER.
+// Load returns nil profile without error when the player has no profile,
+// it is called out of the relay loops and may be called concurrently.
+type PlayerStore interface {
+	Load(joinSeed []byte) ([]byte, error)
+}
+
+// FilePlayerStore reads profiles from Dir, one file per join seed named by its hex string.
+type FilePlayerStore struct {
+	Dir string
+}
+
+func NewFilePlayerStore(dir string) *FilePlayerStore {
+	return &FilePlayerStore{Dir: dir}
+}
+
+// Load refuses files over one frame content before reading them.
+func (s *FilePlayerStore) Load(joinSeed []byte) ([]byte, error) {
+	file, err := os.Open(filepath.Join(s.Dir, hex.EncodeToString(joinSeed)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if math.MaxUint16 < info.Size() {
+		return nil, ErrProfileTooLarge
+	}
+	profile, err := ioutil.ReadAll(io.LimitReader(file, math.MaxUint16+1))
+	if err != nil {
+		return nil, err
+	}
+	if math.MaxUint16 < len(profile) {
+		return nil, ErrProfileTooLarge
+	}
+	return profile, nil
+}
+
+// startLoadPlayer starts loadPlayer unless the sender is loading already or the room loads loadMax players,
+// called from the relay loop.
+func (o *OpenRelay) startLoadPlayer(relay *defs.RoomInstance, header defs.Header, seed []byte, identity []byte, ver byte) {
+	if relay.Loading[header.SrcUid] || loadMax <= len(relay.Loading) {
+		relay.Log.Printf(defs.NOTICE, "load player refused, uid:%d loading:%d", header.SrcUid, len(relay.Loading))
+		o.reject(relay, identity, ver, header, defs.ERROR_LIMIT_EXCEEDED)
+		return
+	}
+	relay.Loading[header.SrcUid] = true
+	go o.loadPlayer(relay, header, seed, identity, ver)
+}
+
+// loadPlayer loads the profile of the sender out of the relay loop and answers it from the loop,
+// so that a slow store does not stall the room. the answer is dropped when the sender left meanwhile.
+func (o *OpenRelay) loadPlayer(relay *defs.RoomInstance, header defs.Header, seed []byte, identity []byte, ver byte) {
+	profile, err := o.PlayerStore.Load(seed)
+	post(relay, func() {
+		delete(relay.Loading, header.SrcUid)
+		uid, ok := relay.Guids[string(seed)]
+		if !ok || uid != header.SrcUid {
+			relay.Log.Printf(defs.NOTICE, "loaded player is not joined, uid:%d", header.SrcUid)
+			return
+		}
+		if err != nil && err != ErrProfileTooLarge {
+			relay.Log.Println(defs.NOTICE, "load player failed. ", err)
+			o.reject(relay, identity, ver, header, defs.ERROR_NOT_FOUND)
+			return
+		}
+		if err == ErrProfileTooLarge || math.MaxUint16 < len(profile) {
+			relay.Log.Printf(defs.NOTICE, "player profile is too large %d", len(profile))
+			o.reject(relay, identity, ver, header, defs.ERROR_FRAME_TOO_LARGE)
+			return
+		}
+		relay.Props[defs.PropKeyPlayerProfilePrefix+strconv.Itoa(int(uid))] = profile
+		err = o.sendMessage(relay, uid, header, &codec.Raw{Data: profile})
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+			return
+		}
+		relay.Log.Printf(defs.VVERBOSE, "load player uid:%d profile len:%d", uid, len(profile))
+	})
+}
@@ -0,0 +1,37 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"openrelay/internal/defs"
+)
+
+// compareProp checks the expected version against the current version of key.
+func compareProp(relay *defs.RoomInstance, key string, expect uint32) (uint32, bool) {
+	current := relay.PropVersions[key]
+	return current, expect == defs.PROP_VERSION_ANY || expect == current
+}
+
+// propLimited reports whether setting value to key exceeds PropValueMax or PropMax keys of the room.
+func (o *OpenRelay) propLimited(relay *defs.RoomInstance, key string, value []byte) bool {
+	if 0 < o.PropValueMax && o.PropValueMax < len(value) {
+		return true
+	}
+	if _, ok := relay.PropVersions[key]; ok {
+		return false
+	}
+	return 0 < o.PropMax && o.PropMax <= len(relay.PropVersions)
+}
@@ -18,18 +18,16 @@ package srvs
 import (
 	"bytes"
 	crand "crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"github.com/zeromq/goczmq"
 	"math"
 	"math/big"
 	"math/rand"
+	"openrelay/internal/codec"
 	"openrelay/internal/defs"
 	"strconv"
 	"strings"
 	"time"
-	//"github.com/pion/dtls/examples/util"
 )
 
 var log *defs.Logger
@@ -40,18 +38,31 @@ func (o *OpenRelay) ServiceInit() {
 	if err != nil {
 		panic("log initialize failed.")
 	}
+	o.detectListenAddrs()
+	for ver := int(o.MinFrameVersion); ver < defs.FrameVersion; ver++ {
+		if _, ok := codec.AdapterOf(byte(ver)); !ok {
+			log.Printf(defs.NOTICE, "frame version %d has no adapter, rejected", ver)
+		}
+	}
 	seed, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64)) // TODO mt19937
 	rand.Seed(seed.Int64())
 	// check stl enable but didn't set
 	stfDealPortArray := strings.Split(o.StfDealPorts, ",")
 	stfSubPortArray := strings.Split(o.StfSubPorts, ",")
+	stlDealPortArray := strings.Split(o.StlDealPorts, ",")
+	stlSubPortArray := strings.Split(o.StlSubPorts, ",")
+	transportArray := strings.Split(o.Transports, ",")
 	portCount := len(stfDealPortArray)
 	for index := 0; index < portCount; index++ {
 		// check port valid
 		// check port count
 		// check port conflict
 		room := defs.RoomParameter{}
-		room.ListenMode = byte(o.ListenMode)
+		room.ListenMode = byte(o.baseListenMode())
+		room.Compression = o.Compression
+		room.CompressMin = o.CompressMin
+		room.Authenticate = o.Authenticate
+		room.Limits = o.RateLimits
 		room.Id, err = defs.NewGuid()
 		if err != nil {
 			log.Panic("guid cannot create, initialize faild. ", err)
@@ -65,7 +76,7 @@ func (o *OpenRelay) ServiceInit() {
 		if err != nil {
 			log.Panic("relay rec initialize faild. ", err)
 		}
-		relayInstance := defs.RoomInstance{Log: relayLog, Rec: rec, ABLoop: defs.ALoop}
+		relayInstance := defs.RoomInstance{Log: relayLog, Rec: rec, RoomKey: &defs.RoomKey{}, ABLoop: defs.ALoop}
 		var port int
 		port, err = strconv.Atoi(stfDealPortArray[index])
 		if err != nil {
@@ -77,7 +88,32 @@ func (o *OpenRelay) ServiceInit() {
 			log.Panic("invalid port, initialize faild. ", err)
 		}
 		room.StfSubPort = uint16(port)
-		room.UseStateless = false
+		room.Transport, err = ParseTransport(transportArray[0])
+		if index < len(transportArray) {
+			room.Transport, err = ParseTransport(transportArray[index])
+		}
+		if err != nil {
+			log.Panic("invalid transport, initialize faild. ", err)
+		}
+		if room.Transport == defs.TRANSPORT_ZMQ && (o.zmqHost(o.StfDealHost) == "" || o.zmqHost(o.StfSubHost) == "") {
+			log.Panic("listen ipv6 addr is unknown, zeromq cannot bind ipv6 only, initialize faild. ", o.ListenIpv6)
+		}
+		room.UseStateless = o.UseStateless
+		if room.UseStateless {
+			if len(stlDealPortArray) <= index || len(stlSubPortArray) <= index {
+				log.Panic("stateless ports are less than statefull ports, initialize faild.")
+			}
+			port, err = strconv.Atoi(stlDealPortArray[index])
+			if err != nil {
+				log.Panic("invalid port, initialize faild. ", err)
+			}
+			room.StlDealPort = uint16(port)
+			port, err = strconv.Atoi(stlSubPortArray[index])
+			if err != nil {
+				log.Panic("invalid port, initialize faild. ", err)
+			}
+			room.StlSubPort = uint16(port)
+		}
 		o.HotRoomQueue = append(o.HotRoomQueue, room.Id)
 		o.RoomQueue[roomIdHexStr] = &room
 		o.RelayQueue[roomIdHexStr] = &relayInstance
@@ -123,8 +159,8 @@ _______________________________________________________________________________
 		roomIdHexStr := defs.GuidFormatString(id)
 		o.Clean(o.RelayQueue[roomIdHexStr], o.RoomQueue[roomIdHexStr].Id)
 		go o.RelayServ(o.RoomQueue[roomIdHexStr], o.RelayQueue[roomIdHexStr])
-		go o.Heatbeat(o.RelayQueue[roomIdHexStr], id)
 	}
+	go o.sweepSessions()
 	log.Printf(defs.INFO, "available room :%d", len(o.HotRoomQueue))
 	log.Printf(defs.INFO, "initialize ok")
 	o.printQueueStatus(defs.VERBOSE)
@@ -158,7 +194,27 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 	relay.Uids = make(map[defs.PlayerId]string)
 	relay.Names = make(map[defs.PlayerId]string)
 	relay.Hbs = make(map[defs.PlayerId]int64)
+	relay.Dcs = make(map[defs.PlayerId]int64)
 	relay.Props = make(map[string][]byte)
+	relay.PropVersions = make(map[string]uint32)
+	relay.Identities = make(map[defs.PlayerId][]byte)
+	relay.Vers = make(map[defs.PlayerId]byte)
+	relay.Accepts = make(map[defs.PlayerId]byte)
+	relay.SessionIds = make(map[defs.PlayerId][16]byte)
+	relay.Rates = make(map[defs.PlayerId]*defs.PlayerRate)
+	relay.Streams = make(map[defs.StreamKey]defs.StreamState)
+	relay.Masks = make(map[defs.PlayerId]byte)
+	relay.Loading = make(map[defs.PlayerId]bool)
+	relay.Stack = make([][]byte, 0)
+	relay.StackHead = 0
+	relay.SpoofCount = 0
+	relay.Seq = 0
+	relay.History = make([]defs.SentFrame, 0)
+	roomKey, err := codec.NewRoomKey()
+	if err != nil {
+		relay.Log.Panic("room key create failed. ", err)
+	}
+	relay.RoomKey.Set(roomKey)
 	relay.LastUid = 0
 	relay.MasterUid = 0
 	relay.MasterUidNeed = true
@@ -171,76 +227,98 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 
 	relay.Log.SetPrefix("| " + roomIdHexStr + " ")
 
-	//addr := &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(room.StlDealPort)}
-	//config := &dtls.Config{
-	//	PSK: func(hint []byte) ([]byte, error) {
-	//		fmt.Printf("Client's hint: %s \n", hint)
-	//		return []byte{0x7C, 0xCD, 0xE1, 0x4A, 0x5C, 0xF3, 0xB7, 0x1C, 0x0C, 0x08, 0xC8, 0xB7, 0xF9, 0xE5}, nil
-	//	},
-	//	PSKIdentityHint:      []byte("oFIrQFrW8EWcZ5u7eGfrkw"),
-	//	CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
-	//	ExtendedMasterSecret: dtls.DisableExtendedMasterSecret, //dtls.RequireExtendedMasterSecret,
-	//	ConnectTimeout:       dtls.ConnectTimeoutOption(30 * time.Second),
-	//}
-	//listener, err := dtls.Listen("udp", addr, config)
-	//util.Check(err)
-	//defer func() {
-	//	util.Check(listener.Close(5 * time.Second))
-	//}()
-	//fmt.Println("Listening")
-	// Simulate a chat session
-	//hub := util.NewHub()
-	//hub.Chat()
-
-	//go func() {
-	//	for {
-	//		// Wait for a connection.
-	//		conn, err := listener.Accept()
-	//		util.Check(err)
-	//		// defer conn.Close() // TODO: graceful shutdown
-	//
-	//		// Register the connection with the chat hub
-	//		hub.Register(conn)
-	//	}
-	//}()
-
-	relay.Router, err = goczmq.NewRouter(o.StfDealProto + "://" + o.StfDealHost + ":" + strconv.Itoa(int(room.StfDealPort)))
-	if err != nil {
-		relay.Log.Panic("relay.Router create relay "+roomIdHexStr+" failed. "+o.StfDealProto+"://"+o.StfDealHost+":"+strconv.Itoa(int(room.StfDealPort)), err)
+	relay.Inbox = make(chan [][]byte, inboxSize)
+	relay.Tasks = make(chan func(), taskSize)
+	relay.Done = make(chan struct{})
+	defer close(relay.Done)
+	relay.Gateway = defs.NewGatewayPeers(tcpQueueSize)
+	defer relay.Gateway.Close()
+	if room.UseStateless {
+		relay.Stl = defs.NewStatelessConns()
+		defer relay.Stl.Close()
+		go o.StatelessServ(room, relay, relay.Inbox)
 	}
-	defer relay.Router.Destroy()
 
-	relay.Pub, err = goczmq.NewPub(o.StfSubProto + "://" + o.StfSubHost + ":" + strconv.Itoa(int(room.StfSubPort)))
-	if err != nil {
-		relay.Log.Panic("relay.Pub create relay "+roomIdHexStr+" failed. "+o.StfSubProto+"://"+o.StfSubHost+":"+strconv.Itoa(int(room.StfSubPort)), err)
+	// a transport set before RelayServ, such as MemTransport, is used as is with the inbox merged into it.
+	if relay.Transport == nil {
+		relay.Transport, err = o.newTransport(room, relay, roomIdHexStr, relay.Inbox)
+		if err != nil {
+			relay.Log.Panic("relay transport create relay "+roomIdHexStr+" failed. ", err)
+		}
+	} else if mem, ok := relay.Transport.(*MemTransport); ok {
+		mem.inbox = relay.Inbox
 	}
-	defer relay.Pub.Destroy()
+	defer relay.Transport.Close()
+	go o.Heatbeat(relay, room.Id)
 
 	relay.Log.Println(defs.VERBOSE, "start relay: ", roomIdHexStr)
 
-	header := defs.Header{}
 	for {
-		request, err := relay.Router.RecvMessage()
+		request, err := relay.Transport.Recv()
+		if err == ErrTransportClosed {
+			relay.Log.Println(defs.VERBOSE, "stop relay: ", roomIdHexStr)
+			return
+		}
+		runTasks(relay)
 		if err != nil {
-			relay.Log.Println(defs.NOTICE, "relay.Router recv failed. ", err)
+			relay.Log.Println(defs.NOTICE, "relay recv failed. ", err)
+			continue
+		}
+		if isLoopWake(request) {
 			continue
 		}
-		relay.Log.Printf(defs.VVERBOSE, "relay.Router received '%s' from '%v'", hex.EncodeToString(request[1]), request[0])
 		if request == nil || len(request) < 2 {
 			relay.Log.Println(defs.NOTICE, "invalid request, request is too short.")
 			continue
 		}
+		relay.Log.Printf(defs.VVERBOSE, "relay received '%s' from '%v'", hex.EncodeToString(request[1]), request[0])
 
-		readBuf := bytes.NewReader(request[1])
-		header = defs.Header{}
-		err = binary.Read(readBuf, binary.LittleEndian, &header)
+		ver, err := codec.FrameVersionOf(request[1])
 		if err != nil {
-			relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+			relay.Log.Println(defs.NOTICE, "frame decode failed. ", err)
 			continue
 		}
+		// until the header is decoded, errors carry the relay code only.
+		header := defs.Header{RelayCode: codec.RelayCodeOf(request[1])}
+
+		sessionId := [codec.SessionIdSize]byte{}
+		if room.Authenticate {
+			frame, frameSessionId, err := codec.Verify(request[1], o.Sessions.Secret)
+			if err != nil {
+				relay.Log.Println(defs.NOTICE, "frame verification failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_UNAUTHENTICATED)
+				continue
+			}
+			request[1], sessionId = frame, frameSessionId
+		}
 
-		if header.Ver != defs.FrameVersion {
-			relay.Log.Printf(defs.NOTICE, "invalid FrameVersion %d != %d", defs.FrameVersion, header.Ver)
+		request[1], err = codec.Upgrade(request[1], o.MinFrameVersion)
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "frame upgrade failed. ", err)
+			o.reject(relay, request[0], 0, header, defs.ERROR_UNSUPPORTED_VERSION)
+			o.replyFrameVersion(relay, request[0], 0)
+			continue
+		}
+		header, err = codec.PeekHeader(request[1])
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "frame decode failed. ", err)
+			o.reject(relay, request[0], ver, header, defs.ERROR_TRUNCATED_FRAME)
+			continue
+		}
+		if o.oversized(room, header) {
+			relay.Log.Printf(defs.NOTICE, "frame is too large, DestLen:%d ContentLen:%d", header.DestLen, header.ContentLen)
+			o.reject(relay, request[0], ver, header, defs.ERROR_FRAME_TOO_LARGE)
+			continue
+		}
+		header, destUids, content, err := codec.DecodeFrame(request[1])
+		if err == codec.ErrShortFrame {
+			relay.Log.Println(defs.NOTICE, "frame decode failed. ", err)
+			o.reject(relay, request[0], ver, header, defs.ERROR_TRUNCATED_FRAME)
+			continue
+		}
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "frame decode failed. ", err)
+			o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 			continue
 		}
 
@@ -254,20 +332,49 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 		relay.Log.Printf(defs.VVERBOSE, "received header.DestLen: '%d' ", header.DestLen)
 		relay.Log.Printf(defs.VVERBOSE, "received header.ContentLen: '%d' ", header.ContentLen)
 
+		if header.Seq != 0 {
+			// sequences are stamped by the server only.
+			header.Seq = 0
+			request[1], _ = codec.SetSeq(request[1], 0)
+		}
+
+		if !verified(relay, header, request[0]) {
+			rejectSpoof(relay, header, request[0])
+			o.reject(relay, request[0], ver, header, defs.ERROR_SPOOFED)
+			continue
+		}
+		if room.Authenticate && !sessionBound(relay, header, sessionId) {
+			relay.Log.Printf(defs.NOTICE, "session is not bound to uid %d", header.SrcUid)
+			o.reject(relay, request[0], ver, header, defs.ERROR_UNAUTHENTICATED)
+			continue
+		}
+		if !allow(room, relay, header, len(request[1])) {
+			o.throttle(room, relay, header)
+			continue
+		}
+
 		switch header.RelayCode {
 		case defs.RELAY, defs.RELAY_STREAM, defs.UNITY_CDK_RELAY, defs.UE4_CDK_RELAY:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
+			}
+			if room.Encrypt && !codec.Sealed(header, content) {
+				relay.Log.Printf(defs.NOTICE, "unsealed payload rejected, uid:%d", header.SrcUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_UNSEALED)
+				continue
+			}
+			if o.unsequenced(header) {
+				relay.Log.Printf(defs.NOTICE, "reliable frame is not published to the room, dest:%d mask:%d", header.DestCode, header.Mask)
+				o.reject(relay, request[0], ver, header, defs.ERROR_DENIED)
+				continue
+			}
+			if header.RelayCode == defs.RELAY_STREAM && !o.trackStream(relay, header, destUids, content) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			//destUids := make([]byte, header.DestLen)
-			//content := make([]byte, header.ContentLen)
-			//err = binary.Read(readBuf, binary.LittleEndian, &destUids)
-			//err = binary.Read(readBuf, binary.LittleEndian, &content)
 
-			err = relay.Pub.SendFrame(request[1], goczmq.FlagNone)
+			err = o.deliver(relay, header, destUids, request[1])
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "send failed. ", err)
 				continue
@@ -279,118 +386,43 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 			}
 
 		case defs.JOIN:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
-				continue
-			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			alignmentLen := uint16(0)
-			alignment := []byte{}
-
-			var seedLen uint16
-			err = binary.Read(readBuf, binary.LittleEndian, &seedLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
-				continue
-			}
-			relay.Log.Printf(defs.VVERBOSE, "received join seedLen: '%d' ", seedLen)
-
-			var nameLen uint16
-			err = binary.Read(readBuf, binary.LittleEndian, &nameLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
-				continue
-			}
-			relay.Log.Printf(defs.VVERBOSE, "received join nameLen: '%d' ", nameLen)
-
-			joinSeed := make([]byte, seedLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &joinSeed)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-
-			relay.Log.Printf(defs.VVERBOSE, "received join seed: '%s' ", hex.EncodeToString(joinSeed))
-
-			//read adjust alignment at seedLen
-			alignmentLen = seedLen % 4
-			if alignmentLen != 0 {
-				alignment = make([]byte, alignmentLen)
-				err = binary.Read(readBuf, binary.LittleEndian, &alignment)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
-					continue
-				}
-			}
-
-			name := make([]byte, nameLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &name)
+			join := codec.Join{}
+			err = join.Unmarshal(content)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
+			relay.Log.Printf(defs.VVERBOSE, "received join seed: '%s' ", hex.EncodeToString(join.Seed))
+			relay.Log.Printf(defs.VVERBOSE, "received join name: '%s' ", string(join.Name))
 
-			relay.Log.Printf(defs.VVERBOSE, "received join name: '%s' ", string(name))
-
-			assginUid := relay.Guids[string(joinSeed)]
-			relay.Names[relay.LastUid] = string(name)
-			header.SrcUid = relay.LastUid
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-			err = binary.Write(writeBuf, binary.LittleEndian, assginUid)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-			err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-			err = binary.Write(writeBuf, binary.LittleEndian, seedLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-			err = binary.Write(writeBuf, binary.LittleEndian, nameLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-
-			err = binary.Write(writeBuf, binary.LittleEndian, joinSeed)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			assginUid, ok := relay.Guids[string(join.Seed)]
+			if !ok || assginUid != header.SrcUid || !statelessBound(relay, request[0], join.Seed) {
+				rejectSpoof(relay, header, request[0])
+				o.reject(relay, request[0], ver, header, defs.ERROR_SPOOFED)
 				continue
 			}
-			//write adjust alignment at seedLen.
-			alignmentLen = seedLen % 4
-			if alignmentLen != 0 {
-				alignment = make([]byte, alignmentLen)
-				err = binary.Write(writeBuf, binary.LittleEndian, alignment)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-					continue
-				}
-			}
-
-			err = binary.Write(writeBuf, binary.LittleEndian, name)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			if bound, ok := relay.Identities[assginUid]; ok && !bytes.Equal(bound, request[0]) {
+				rejectSpoof(relay, header, request[0])
+				o.reject(relay, request[0], ver, header, defs.ERROR_SPOOFED)
 				continue
 			}
-
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			relay.Identities[assginUid] = request[0]
+			relay.Vers[assginUid] = ver
+			readAccepts(room, relay, &header, assginUid)
+			relay.SessionIds[assginUid] = sessionId
+			relay.Names[assginUid] = string(join.Name)
+			notice := codec.JoinNotice{AssignUid: assginUid, MasterUid: relay.MasterUid, Name: join.Name}
+			err = o.publishMessage(relay, header, &notice)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(writeBuf.Bytes()))
+			relay.Log.Printf(defs.VVERBOSE, "-> join uid:%d name:'%s' ", assginUid, string(join.Name))
 
 			if o.RecMode == int(relay.LastUid) {
 				relay.Rec.Printf("relay.LastUid: %d", relay.LastUid)
@@ -398,45 +430,40 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 			}
 
 		case defs.LEAVE:
-			joinSeed := make([]byte, header.ContentLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &joinSeed)
+			leave := codec.Seed{}
+			err = leave.Unmarshal(content)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			srcUid := relay.Guids[string(joinSeed)]
+			srcUid := relay.Guids[string(leave.Seed)]
 			if srcUid != header.SrcUid {
-				relay.Log.Printf(defs.NOTICE, "invalid srcUid %l !=  %l", srcUid, header.SrcUid)
+				relay.Log.Printf(defs.NOTICE, "invalid srcUid %d != %d", srcUid, header.SrcUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			delete(relay.Guids, string(joinSeed))
+			dropStateless(relay, srcUid)
+			delete(relay.Guids, string(leave.Seed))
 			delete(relay.Uids, srcUid)
 			delete(relay.Names, srcUid)
 			delete(relay.Hbs, srcUid)
+			delete(relay.Dcs, srcUid)
+			delete(relay.Identities, srcUid)
+			delete(relay.Vers, srcUid)
+			delete(relay.Accepts, srcUid)
+			delete(relay.SessionIds, srcUid)
+			delete(relay.Rates, srcUid)
+			delete(relay.Masks, srcUid)
+			o.dropStreams(relay, srcUid)
 
 			if len(relay.Guids) == 0 {
 				o.Clean(relay, room.Id)
 			} else if relay.MasterUid == srcUid {
-				for i, _ := range relay.Uids {
-					relay.MasterUid = i
-					break
-				}
+				relay.MasterUid = pickMaster(relay)
 			}
 
-			header.ContentLen = 0
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-			err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-				continue
-			}
-
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			err = o.publishMessage(relay, header, &codec.Master{MasterUid: relay.MasterUid})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
@@ -444,96 +471,97 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 			relay.Log.Println(defs.INFO, "-> leave ", srcUid)
 
 		case defs.TIMEOUT:
-		case defs.REJOIN:
-		case defs.SET_LEGACY_MAP:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "invalid srcUid: ", header.SrcUid)
+			if o.RejoinGrace <= 0 {
+				relay.Log.Println(defs.NOTICE, "rejoin grace is disabled.")
+				o.reject(relay, request[0], ver, header, defs.ERROR_DENIED)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			var keysLen uint16
-			err = binary.Read(readBuf, binary.LittleEndian, &keysLen)
+			timeout := codec.Seed{}
+			err = timeout.Unmarshal(content)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "received join keysLen: '%d' ", keysLen)
-
-			var propsLen uint16
-			err = binary.Read(readBuf, binary.LittleEndian, &propsLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+			srcUid, ok := relay.Guids[string(timeout.Seed)]
+			if !ok || srcUid != header.SrcUid {
+				relay.Log.Printf(defs.NOTICE, "invalid srcUid %d != %d", srcUid, header.SrcUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "received join propsLen: '%d' ", propsLen)
-
-			keysBytes := make([]byte, keysLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &keysBytes)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+			if _, ok := relay.Hbs[srcUid]; !ok {
+				relay.Log.Println(defs.NOTICE, "source uid is not connected ", srcUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
+			o.disconnect(relay, srcUid)
 
-			//read adjust alignment at keysLen
-			var alignmentLen = keysLen % 4
-			if alignmentLen != 0 {
-				var alignment = make([]byte, alignmentLen)
-				err = binary.Read(readBuf, binary.LittleEndian, &alignment)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
-					continue
-				}
-			}
-
-			properties := make([]byte, propsLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &properties)
+		case defs.REJOIN:
+			rejoin := codec.RejoinSeed{}
+			err = rejoin.Unmarshal(content)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			relay.Props[defs.PropKeyLegacy] = properties
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			srcUid, ok := relay.Guids[string(rejoin.Seed)]
+			if !ok {
+				relay.Log.Printf(defs.NOTICE, "rejoin seed is not found %s", hex.EncodeToString(rejoin.Seed))
+				o.reject(relay, request[0], ver, header, defs.ERROR_NOT_FOUND)
 				continue
 			}
-
-			err = binary.Write(writeBuf, binary.LittleEndian, keysLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			// only players timed out and still in the rejoin grace are rebound.
+			if _, ok := relay.Dcs[srcUid]; !ok {
+				relay.Log.Println(defs.NOTICE, "rejoin uid is not waiting rejoin ", srcUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_DENIED)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, propsLen)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			// join seeds may be known to others, the rejoin token and the session are of the seed owner only.
+			if !codec.ValidRejoinToken(relay.RoomKey.Get(), rejoin.Seed, rejoin.Token) {
+				rejectSpoof(relay, header, request[0])
+				o.reject(relay, request[0], ver, header, defs.ERROR_SPOOFED)
+				continue
+			}
+			if (room.Authenticate && relay.SessionIds[srcUid] != sessionId) || !statelessBound(relay, request[0], rejoin.Seed) {
+				rejectSpoof(relay, header, request[0])
+				o.reject(relay, request[0], ver, header, defs.ERROR_SPOOFED)
 				continue
 			}
+			delete(relay.Dcs, srcUid)
+			relay.Hbs[srcUid] = time.Now().Unix()
+			relay.Identities[srcUid] = request[0]
+			relay.Vers[srcUid] = ver
+			readAccepts(room, relay, &header, srcUid)
+			relay.SessionIds[srcUid] = sessionId
 
-			err = binary.Write(writeBuf, binary.LittleEndian, keysBytes)
+			header.SrcUid = srcUid
+			err = o.publishMessage(relay, header, &codec.Rejoin{Uid: srcUid, MasterUid: relay.MasterUid})
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
+			relay.Log.Println(defs.INFO, "-> rejoin ", srcUid)
 
-			//write adjust alignment at keysLen.
-			alignmentLen = keysLen % 4
-			if alignmentLen != 0 {
-				var alignment = make([]byte, alignmentLen)
-				err = binary.Write(writeBuf, binary.LittleEndian, alignment)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-					continue
-				}
+		case defs.SET_LEGACY_MAP:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
 			}
-
-			err = binary.Write(writeBuf, binary.LittleEndian, properties)
+			content, err = readContent(room, relay, &header, content)
+			if err != nil {
+				relay.Log.Println(defs.NOTICE, "decompress failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
+				continue
+			}
+			legacyMap := codec.LegacyMap{}
+			err = legacyMap.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			relay.Props[defs.PropKeyLegacy] = legacyMap.Props
+			err = o.publishCompressed(room, relay, header, &legacyMap)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
@@ -541,54 +569,55 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 			relay.Log.Printf(defs.VVERBOSE, "set legacy map %s \n", relay.Props[defs.PropKeyLegacy])
 
 		case defs.GET_LEGACY_MAP:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "invalid srcUid: ", header.SrcUid)
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			header.ContentLen = uint16(len(relay.Props[defs.PropKeyLegacy]))
-			properties := relay.Props[defs.PropKeyLegacy]
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
+			err = o.sendCompressed(room, relay, header.SrcUid, header, &codec.Raw{Data: relay.Props[defs.PropKeyLegacy]})
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, properties)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			relay.Log.Printf(defs.VVERBOSE, "get legacy map %s \n", relay.Props[defs.PropKeyLegacy])
+
+		case defs.GET_USERS:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			err = o.sendMessage(relay, header.SrcUid, header, o.users(relay))
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "get legacy map %s \n", relay.Props[defs.PropKeyLegacy])
+			relay.Log.Printf(defs.VVERBOSE, "get users %d", len(relay.Uids))
 
-		case defs.GET_USERS:
 		case defs.SET_MASTER:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			header.ContentLen = 0
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
+			target := codec.Target{}
+			err = target.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			if header.SrcUid != relay.MasterUid {
+				relay.Log.Printf(defs.NOTICE, "set master denied, source uid %d is not master %d", header.SrcUid, relay.MasterUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_DENIED)
 				continue
 			}
+			if _, ok := relay.Hbs[target.Uid]; !ok {
+				relay.Log.Println(defs.NOTICE, "target uid is invalid ", target.Uid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
+			}
+			relay.MasterUid = target.Uid
+			relay.Log.Printf(defs.INFO, "-> master changed %d -> %d", header.SrcUid, target.Uid)
 
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			err = o.publishMessage(relay, header, &codec.Master{MasterUid: relay.MasterUid})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
@@ -596,244 +625,351 @@ func (o *OpenRelay) RelayServ(room *defs.RoomParameter, relay *defs.RoomInstance
 			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
 
 		case defs.GET_MASTER:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			header.ContentLen = 2
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
+			err = o.sendMessage(relay, header.SrcUid, header, &codec.Master{MasterUid: relay.MasterUid})
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+				continue
+			}
+			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
+
+		case defs.GET_SERVER_TIMESTAMP:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
+			timestamp := uint16(time.Since(startTime) / time.Second)
+			err = o.sendMessage(relay, header.SrcUid, header, &codec.ServerTimestamp{Timestamp: timestamp})
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
+			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
 
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+		case defs.RELAY_LATEST, defs.UNITY_CDK_RELAY_LATEST, defs.UE4_CDK_RELAY_LATEST:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
+			}
+			content, err = readContent(room, relay, &header, content)
+			if err != nil {
+				relay.Log.Println(defs.NOTICE, "decompress failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
+				continue
+			}
+			relay.Props[defs.PropKeyPlayerPrefix+strconv.Itoa(int(header.SrcUid))] = content
+			err = o.publishCompressed(room, relay, header, &codec.Raw{Data: content})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
 			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
 
-		case defs.GET_SERVER_TIMESTAMP:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
+		case defs.GET_LATEST, defs.UNITY_CDK_GET_LATEST, defs.UE4_CDK_GET_LATEST:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
+			}
+			target := codec.Target{}
+			err = target.Unmarshal(content)
+			if err != nil {
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
+			relay.Log.Printf(defs.VVERBOSE, "get latest uid:%d latest stack", target.Uid)
 
-			timestamp := uint16(time.Since(startTime) / time.Second)
-			header.ContentLen = 2
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
+			properties := relay.Props[defs.PropKeyPlayerPrefix+strconv.Itoa(int(target.Uid))]
+			err = o.sendCompressed(room, relay, header.SrcUid, header, &codec.Raw{Data: properties})
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, timestamp)
+			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
+
+		case defs.SET_LOBBY_MAP:
+			//if !touch(relay, header.SrcUid) {
+			//	continue
+			//}
+			content, err = readContent(room, relay, &header, content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "decompress failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			relay.Props[defs.PropKeyLegacyLobby] = content
+			err = o.publishCompressed(room, relay, header, &codec.Raw{Data: content})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
+			relay.Log.Printf(defs.VVERBOSE, "set lobby map %s \n", relay.Props[defs.PropKeyLegacyLobby])
 
-		case defs.RELAY_LATEST, defs.UNITY_CDK_RELAY_LATEST, defs.UE4_CDK_RELAY_LATEST:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
+		case defs.GET_LOBBY_MAP:
+			//if !touch(relay, header.SrcUid) {
+			//	continue
+			//}
+			if _, ok := relay.Identities[header.SrcUid]; ok {
+				err = o.sendCompressed(room, relay, header.SrcUid, header, &codec.Raw{Data: relay.Props[defs.PropKeyLegacyLobby]})
+			} else {
+				err = o.reply(relay, request[0], ver, header, &codec.Raw{Data: relay.Props[defs.PropKeyLegacyLobby]})
+			}
+			if err != nil {
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
+			relay.Log.Printf(defs.VVERBOSE, "get lobby map %s \n", relay.Props[defs.PropKeyLegacyLobby])
 
-			properties := make([]byte, header.ContentLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &properties)
-			relay.Props[defs.PropKeyPlayerPrefix+strconv.Itoa(int(header.SrcUid))] = properties
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
+		case defs.REPLAY_JOIN:
+			replayJoin := codec.Seed{}
+			err = replayJoin.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "read joinseed failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, properties)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			if !statelessBound(relay, request[0], replayJoin.Seed) {
+				rejectSpoof(relay, header, request[0])
+				o.reject(relay, request[0], ver, header, defs.ERROR_SPOOFED)
 				continue
 			}
+			relay.LastUid += 1
+			if relay.MasterUidNeed {
+				relay.MasterUidNeed = false
+				relay.MasterUid = relay.LastUid
+			}
+			assginUid := relay.LastUid
+			joinedUids := []defs.PlayerId{}
+			for k := range relay.Uids {
+				joinedUids = append(joinedUids, k)
+			}
+			relay.Guids[string(replayJoin.Seed)] = relay.LastUid
+			relay.Uids[relay.LastUid] = string(replayJoin.Seed)
+			relay.Identities[relay.LastUid] = request[0]
+			relay.Vers[relay.LastUid] = ver
+			readAccepts(room, relay, &header, relay.LastUid)
+			relay.SessionIds[relay.LastUid] = sessionId
+			relay.Hbs[relay.LastUid] = time.Now().Unix()
 
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			err = o.publishMessage(relay, header, &codec.ReplayJoin{AssignUid: assginUid, MasterUid: relay.MasterUid, JoinedUids: joinedUids})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
 			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
+			if o.RecMode == int(relay.LastUid) {
+				relay.Rec.Printf("relay.LastUid: %d", relay.LastUid)
+				relay.Rec.Printf("%d\t%s\t%d\t%s", time.Now().UnixNano(), relay.ABLoop, header.RelayCode, hex.EncodeToString(request[1]))
+			}
 
-		case defs.GET_LATEST, defs.UNITY_CDK_GET_LATEST, defs.UE4_CDK_GET_LATEST:
-			if _, ok := relay.Hbs[header.SrcUid]; !ok {
-				relay.Log.Println(defs.NOTICE, "source uid is invalid ", header.SrcUid)
+		case defs.PUSH_STACK:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			var targetUid uint16
-			err = binary.Read(readBuf, binary.LittleEndian, &targetUid)
+			if math.MaxUint16-4 < len(content) {
+				relay.Log.Printf(defs.NOTICE, "push stack content is too large %d", len(content))
+				o.reject(relay, request[0], ver, header, defs.ERROR_FRAME_TOO_LARGE)
+				continue
+			}
+			index := o.pushStack(relay, content)
+			err = o.publishMessage(relay, header, &codec.StackPushed{Index: index, Content: content})
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "get latest uid:%d latest stack", targetUid)
+			relay.Log.Printf(defs.VVERBOSE, "push stack index:%d head:%d len:%d", index, relay.StackHead, len(relay.Stack))
 
-			properties := relay.Props[defs.PropKeyPlayerPrefix+strconv.Itoa(int(header.SrcUid))]
-			header.ContentLen = uint16(len(properties))
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+		case defs.FETCH_STACK:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, properties)
+			fetch := codec.StackFetch{}
+			err = fetch.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			err = o.sendMessage(relay, header.SrcUid, header, o.fetchStack(relay, fetch.FromIndex))
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
+			relay.Log.Printf(defs.VVERBOSE, "fetch stack from index:%d head:%d len:%d", fetch.FromIndex, relay.StackHead, len(relay.Stack))
 
-		case defs.SET_LOBBY_MAP:
-			//if _, ok := relay.Hbs[header.SrcUid]; !ok {
-			//	relay.Log.Println(defs.NOTICE, "invalid srcUid: ", header.SrcUid)
-			//	continue
-			//}
-			//relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			properties := make([]byte, header.ContentLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &properties)
+		case defs.LOAD_PLAYER:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
+			}
+			loadPlayer := codec.Seed{}
+			err = loadPlayer.Unmarshal(content)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			relay.Props[defs.PropKeyLegacyLobby] = properties
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			srcUid := relay.Guids[string(loadPlayer.Seed)]
+			if srcUid != header.SrcUid {
+				relay.Log.Printf(defs.NOTICE, "invalid srcUid %d != %d", srcUid, header.SrcUid)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, properties)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			profile, ok := relay.Props[defs.PropKeyPlayerProfilePrefix+strconv.Itoa(int(srcUid))]
+			if !ok {
+				o.startLoadPlayer(relay, header, loadPlayer.Seed, request[0], ver)
 				continue
 			}
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			err = o.sendMessage(relay, srcUid, header, &codec.Raw{Data: profile})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "set lobby map %s \n", relay.Props[defs.PropKeyLegacyLobby])
+			relay.Log.Printf(defs.VVERBOSE, "load player uid:%d profile len:%d", srcUid, len(profile))
 
-		case defs.GET_LOBBY_MAP:
-			//if _, ok := relay.Hbs[header.SrcUid]; !ok {
-			//	relay.Log.Println(defs.NOTICE, "invalid srcUid: ", header.SrcUid)
-			//	continue
-			//}
-			//relay.Hbs[header.SrcUid] = time.Now().Unix()
-
-			header.ContentLen = uint16(len(relay.Props[defs.PropKeyLegacyLobby]))
-			properties := relay.Props[defs.PropKeyLegacyLobby]
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+		case defs.SET_SHARE_PROP, defs.DELETE_SHARE_PROP:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, properties)
+			prop := codec.Prop{}
+			err = prop.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
+				continue
+			}
+			propKey := defs.PropKeyGenericPrefix + string(prop.Key)
+			if header.RelayCode == defs.SET_SHARE_PROP && o.propLimited(relay, propKey, prop.Value) {
+				relay.Log.Printf(defs.NOTICE, "share prop limit exceeded key:%s len:%d props:%d", prop.Key, len(prop.Value), len(relay.PropVersions))
+				o.reject(relay, request[0], ver, header, defs.ERROR_LIMIT_EXCEEDED)
+				continue
+			}
+			if _, ok := relay.PropVersions[propKey]; header.RelayCode == defs.DELETE_SHARE_PROP && !ok {
+				relay.Log.Printf(defs.VERBOSE, "share prop not found key:%s", prop.Key)
+				o.reject(relay, request[0], ver, header, defs.ERROR_NOT_FOUND)
+				continue
+			}
+			current, ok := compareProp(relay, propKey, prop.Version)
+			if !ok {
+				result := codec.PropResult{Status: defs.PROP_CONFLICT, Prop: codec.Prop{Key: prop.Key, Value: relay.Props[propKey], Version: current}}
+				err = o.sendMessage(relay, header.SrcUid, header, &result)
+				if err != nil {
+					relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+				}
+				relay.Log.Printf(defs.VERBOSE, "share prop conflict key:%s version:%d != %d", prop.Key, prop.Version, current)
 				continue
 			}
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			if header.RelayCode == defs.SET_SHARE_PROP {
+				prop.Version = current + 1
+				relay.Props[propKey] = prop.Value
+				relay.PropVersions[propKey] = prop.Version
+			} else {
+				prop.Version = 0
+				prop.Value = nil
+				delete(relay.Props, propKey)
+				delete(relay.PropVersions, propKey)
+			}
+			err = o.publishMessage(relay, header, &codec.PropResult{Status: defs.PROP_OK, Prop: prop})
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "get legacy map %s \n", relay.Props[defs.PropKeyLegacy])
+			relay.Log.Printf(defs.VVERBOSE, "share prop %d key:%s version:%d", header.RelayCode, prop.Key, prop.Version)
 
-		case defs.REPLAY_JOIN:
-			relay.LastUid += 1
-			if relay.MasterUidNeed {
-				relay.MasterUidNeed = false
-				relay.MasterUid = relay.LastUid
+		case defs.GET_SHARE_PROP:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
 			}
-			joinSeed := make([]byte, header.ContentLen)
-			err = binary.Read(readBuf, binary.LittleEndian, &joinSeed)
+			prop := codec.Prop{}
+			err = prop.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "read joinseed failed. ", err)
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			assginUid := relay.LastUid
-			//relay.MasterUid := relay.MasterUid
-			joinedUids := []defs.PlayerId{}
-			for k, _ := range relay.Uids {
-				joinedUids = append(joinedUids, k)
+			propKey := defs.PropKeyGenericPrefix + string(prop.Key)
+			result := codec.PropResult{Status: defs.PROP_OK, Prop: codec.Prop{Key: prop.Key, Value: relay.Props[propKey], Version: relay.PropVersions[propKey]}}
+			if _, ok := relay.Props[propKey]; !ok {
+				result.Status = defs.PROP_NOT_FOUND
 			}
-			relay.Guids[string(joinSeed)] = relay.LastUid
-			relay.Uids[relay.LastUid] = string(joinSeed)
-			writeBuf := new(bytes.Buffer)
-			err = binary.Write(writeBuf, binary.LittleEndian, header)
+			err = o.sendMessage(relay, header.SrcUid, header, &result)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, assginUid)
-			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+			relay.Log.Printf(defs.VVERBOSE, "get share prop key:%s version:%d", prop.Key, result.Version)
+
+		case defs.SET_MASK, defs.GET_MASK:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
+			if header.RelayCode == defs.SET_MASK {
+				relay.Masks[header.SrcUid] = header.Mask
+			}
+			mask, ok := relay.Masks[header.SrcUid]
+			if !ok {
+				mask = defs.MASK_ALL
+			}
+			header.Mask = mask
+			err = o.sendMessage(relay, header.SrcUid, header, nil)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+				continue
+			}
+			relay.Log.Printf(defs.VVERBOSE, "mask uid:%d mask:%08b", header.SrcUid, mask)
+
+		case defs.RESEND:
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
 				continue
 			}
-			err = binary.Write(writeBuf, binary.LittleEndian, joinedUids)
+			resend := codec.Resend{}
+			err = resend.Unmarshal(content)
 			if err != nil {
-				relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+				relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_CONTENT)
 				continue
 			}
-			relay.Hbs[relay.LastUid] = time.Now().Unix()
-
-			err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
+			count := o.resend(relay, header.SrcUid, &resend)
+			header.ContentCode = 0
+			err = o.sendMessage(relay, header.SrcUid, header, &resend)
 			if err != nil {
 				relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
 				continue
 			}
-			relay.Log.Printf(defs.VVERBOSE, "-> relay '%s' ", hex.EncodeToString(request[1]))
-			if o.RecMode == int(relay.LastUid) {
-				relay.Rec.Printf("relay.LastUid: %d", relay.LastUid)
-				relay.Rec.Printf("%d\t%s\t%d\t%s", time.Now().UnixNano(), relay.ABLoop, header.RelayCode, hex.EncodeToString(request[1]))
-			}
+			relay.Log.Printf(defs.VVERBOSE, "resend uid:%d seq:%d - %d count:%d", header.SrcUid, resend.FromSeq, resend.ToSeq, count)
+
+		case defs.FRAME_VERSION:
+			o.replyFrameVersion(relay, request[0], ver)
+			relay.Log.Printf(defs.VVERBOSE, "frame version %d", ver)
 
-		case defs.PUSH_STACK:
-			relay.Log.Printf(defs.VERBOSE, "message code defs.PUSH_STACK ... %d\n", header.RelayCode)
-		case defs.FETCH_STACK:
-			relay.Log.Printf(defs.VERBOSE, "message code defs.FETCH_STACK ... %d\n", header.RelayCode)
 		case defs.CONNECT:
 		default:
-			relay.Log.Printf(defs.NOTICE, "invalid message code ... %d\n", header.RelayCode)
+			handler, ok := o.Handlers[header.RelayCode]
+			if !ok {
+				relay.Log.Printf(defs.NOTICE, "invalid message code ... %d\n", header.RelayCode)
+				o.reject(relay, request[0], ver, header, defs.ERROR_UNKNOWN_CODE)
+				continue
+			}
+			if !touch(relay, header.SrcUid) {
+				o.reject(relay, request[0], ver, header, defs.ERROR_INVALID_UID)
+				continue
+			}
+			err = handler(&HandlerContext{Relay: relay, Header: header, DestUids: destUids, o: o}, content)
+			if err != nil {
+				relay.Log.Printf(defs.NOTICE, "handler %d failed. %v", header.RelayCode, err)
+				o.reject(relay, request[0], ver, header, defs.ERROR_HANDLER_FAILED)
+				continue
+			}
+			relay.Log.Printf(defs.VVERBOSE, "-> handler %d '%s' ", header.RelayCode, hex.EncodeToString(request[1]))
 		}
 
 		time.Sleep(0 * time.Second) // return context
@@ -851,7 +987,28 @@ func (o *OpenRelay) Clean(relay *defs.RoomInstance, roomId [16]byte) {
 	relay.Uids = make(map[defs.PlayerId]string)
 	relay.Names = make(map[defs.PlayerId]string)
 	relay.Hbs = make(map[defs.PlayerId]int64)
+	relay.Dcs = make(map[defs.PlayerId]int64)
 	relay.Props = make(map[string][]byte)
+	relay.PropVersions = make(map[string]uint32)
+	relay.Identities = make(map[defs.PlayerId][]byte)
+	relay.Vers = make(map[defs.PlayerId]byte)
+	relay.Accepts = make(map[defs.PlayerId]byte)
+	relay.SessionIds = make(map[defs.PlayerId][16]byte)
+	relay.Rates = make(map[defs.PlayerId]*defs.PlayerRate)
+	relay.Streams = make(map[defs.StreamKey]defs.StreamState)
+	relay.Masks = make(map[defs.PlayerId]byte)
+	relay.Loading = make(map[defs.PlayerId]bool)
+	relay.Stack = make([][]byte, 0)
+	relay.StackHead = 0
+	relay.SpoofCount = 0
+	relay.Seq = 0
+	relay.History = make([]defs.SentFrame, 0)
+	// without a room key, joins to encrypted and stateless rooms are refused until the next clean.
+	roomKey, err := codec.NewRoomKey()
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "room key create failed. ", err)
+	}
+	relay.RoomKey.Set(roomKey)
 	relay.LastUid = 0
 	relay.MasterUid = 0
 	relay.MasterUidNeed = true
@@ -868,60 +1025,108 @@ func (o *OpenRelay) Clean(relay *defs.RoomInstance, roomId [16]byte) {
 	relay.Log.Printf(defs.INFO, "cleaning room ok, id:%s", roomIdHexStr)
 }
 
+// Heatbeat posts heatbeat checks to the relay loop until the loop returns.
 func (o *OpenRelay) Heatbeat(relay *defs.RoomInstance, roomId [16]byte) {
-	var err error
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			post(relay, func() { o.checkHeatbeat(relay, roomId) })
+		case <-relay.Done:
+			return
+		}
+	}
+}
 
-	interval := time.Duration(500)
+// checkHeatbeat disconnects players over heatbeat timeout, and forces leave of players over rejoin grace.
+func (o *OpenRelay) checkHeatbeat(relay *defs.RoomInstance, roomId [16]byte) {
 	timeout := int64(o.HeatbeatTimeout)
-	for {
-		for k, v := range relay.Hbs {
-			if v+timeout < time.Now().Unix() {
-				g := relay.Uids[k]
-				delete(relay.Guids, g)
-				delete(relay.Uids, k)
-				delete(relay.Names, k)
-				delete(relay.Hbs, k)
-
-				if len(relay.Guids) > 0 && relay.MasterUid == k {
-					for i, _ := range relay.Uids {
-						relay.MasterUid = i
-						break
-					}
-				}
-				header := defs.Header{}
-				header.Ver = 0
-				header.RelayCode = defs.LEAVE
-				header.ContentCode = 0
-				header.DestCode = defs.ALL
-				header.Mask = 0
-				header.SrcUid = k
-				header.DestLen = 0
-				header.ContentLen = 0
-				writeBuf := new(bytes.Buffer)
-				err = binary.Write(writeBuf, binary.LittleEndian, header)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-					break
-				}
-				err = binary.Write(writeBuf, binary.LittleEndian, relay.MasterUid)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
-					continue
-				}
+	grace := int64(o.RejoinGrace)
+	for k, v := range relay.Hbs {
+		if v+timeout < time.Now().Unix() {
+			if 0 < grace {
+				o.disconnect(relay, k)
+				continue
+			}
+			o.forceLeave(relay, roomId, k)
+			continue
+		}
+		relay.Log.Printf(defs.VVERBOSE, "-> heatbeat check ok uid: %d time: %d < %d \n", k, v+timeout, time.Now().Unix())
+	}
+	for k, v := range relay.Dcs {
+		if v+grace < time.Now().Unix() {
+			o.forceLeave(relay, roomId, k)
+		}
+	}
+}
 
-				err = relay.Pub.SendFrame(writeBuf.Bytes(), goczmq.FlagNone)
-				if err != nil {
-					relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
-				}
-				relay.Log.Printf(defs.INFO, "-> timeout force logout %s %d", hex.EncodeToString([]byte(g)), k)
+// disconnect keeps uid, name, master and props of uid until rejoin grace is over,
+// the session id is kept to check the rejoin.
+func (o *OpenRelay) disconnect(relay *defs.RoomInstance, uid defs.PlayerId) {
+	dropStateless(relay, uid)
+	delete(relay.Hbs, uid)
+	delete(relay.Identities, uid)
+	delete(relay.Vers, uid)
+	delete(relay.Accepts, uid)
+	delete(relay.Rates, uid)
+	o.dropStreams(relay, uid)
+	relay.Dcs[uid] = time.Now().Unix()
 
-				if len(relay.Guids) == 0 {
-					o.Clean(relay, roomId)
-				}
+	header := defs.Header{}
+	header.Ver = defs.FrameVersion
+	header.RelayCode = defs.TIMEOUT
+	header.DestCode = defs.ALL
+	header.SrcUid = uid
+	err := o.publishMessage(relay, header, &codec.Master{MasterUid: relay.MasterUid})
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+	}
+	relay.Log.Printf(defs.INFO, "-> timeout wait rejoin %s %d", hex.EncodeToString([]byte(relay.Uids[uid])), uid)
+}
 
-			}
-			relay.Log.Printf(defs.VVERBOSE, "-> heatbeat check ok uid: %d time: %d < %d \n", k, v+timeout, time.Now().Unix())
-		}
-		time.Sleep(interval * time.Millisecond) // return context
+func (o *OpenRelay) forceLeave(relay *defs.RoomInstance, roomId [16]byte, uid defs.PlayerId) {
+	dropStateless(relay, uid)
+	g := relay.Uids[uid]
+	delete(relay.Guids, g)
+	delete(relay.Uids, uid)
+	delete(relay.Names, uid)
+	delete(relay.Hbs, uid)
+	delete(relay.Dcs, uid)
+	delete(relay.Identities, uid)
+	delete(relay.Vers, uid)
+	delete(relay.Accepts, uid)
+	delete(relay.SessionIds, uid)
+	delete(relay.Rates, uid)
+	delete(relay.Masks, uid)
+	o.dropStreams(relay, uid)
+
+	if len(relay.Guids) > 0 && relay.MasterUid == uid {
+		relay.MasterUid = pickMaster(relay)
+	}
+	header := defs.Header{}
+	header.Ver = defs.FrameVersion
+	header.RelayCode = defs.LEAVE
+	header.DestCode = defs.ALL
+	header.SrcUid = uid
+	err := o.publishMessage(relay, header, &codec.Master{MasterUid: relay.MasterUid})
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+	}
+	relay.Log.Printf(defs.INFO, "-> timeout force logout %s %d", hex.EncodeToString([]byte(g)), uid)
+
+	if len(relay.Guids) == 0 {
+		o.Clean(relay, roomId)
+	}
+}
+
+// pickMaster prefers connected players over players waiting rejoin.
+func pickMaster(relay *defs.RoomInstance) defs.PlayerId {
+	for i := range relay.Hbs {
+		return i
+	}
+	for i := range relay.Uids {
+		return i
 	}
+	return 0
 }
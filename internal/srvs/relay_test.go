@@ -0,0 +1,455 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"os"
+	"testing"
+	"time"
+)
+
+const testTimeout = 2 * time.Second
+
+// testDir holds the logs of every test room.
+var testDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	testDir, err = ioutil.TempDir("", "openrelay-test")
+	if err != nil {
+		panic(err)
+	}
+	log, err = defs.NewLogger(defs.NONE, testDir, defs.ServiceLogFilePrefix+defs.FileSuffix, false)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	log.Close()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// testRoom runs RelayServ of one room over MemTransport.
+type testRoom struct {
+	t     *testing.T
+	o     *OpenRelay
+	room  *defs.RoomParameter
+	relay *defs.RoomInstance
+	mem   *MemTransport
+	sub   <-chan []byte
+}
+
+func newTestOpenRelay() *OpenRelay {
+	return &OpenRelay{
+		LogLevel:            defs.NONE,
+		LogDir:              testDir,
+		HeatbeatTimeout:     60,
+		JoinTimeout:         5,
+		StackMax:            16,
+		ContentMax:          math.MaxUint16,
+		HistoryMax:          16,
+		PropMax:             16,
+		PropValueMax:        256,
+		MinFrameVersion:     defs.MinFrameVersion,
+		Sessions:            NewSessions(0, 0),
+		Handlers:            make(map[defs.RelayCode]RelayHandler),
+		JoinAllPollingQueue: make(map[string][][]byte),
+		JoinAllProcessQueue: make(map[string]defs.RoomJoinRequest),
+		JoinAllTimeoutQueue: make(map[string][]defs.RoomJoinRequest),
+		RoomQueue:           make(map[string]*defs.RoomParameter),
+		RelayQueue:          make(map[string]*defs.RoomInstance),
+		ReserveRooms:        make(map[string][16]byte),
+		ResolveRoomIds:      make(map[string]string),
+	}
+}
+
+// startTestRoom starts RelayServ, and returns once the relay loop answers, callers stop the room.
+func startTestRoom(t *testing.T, o *OpenRelay) *testRoom {
+	relayLog, err := defs.NewLogger(o.LogLevel, o.LogDir, defs.RelayLogFilePrefix+defs.FileSuffix, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := defs.NewRecorder(o.LogDir, defs.RelayRecFilePrefix+defs.FileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemTransport(64)
+	r := &testRoom{
+		t:     t,
+		o:     o,
+		room:  &defs.RoomParameter{Id: [16]byte{1}, Capacity: 8},
+		relay: &defs.RoomInstance{Log: relayLog, Rec: rec, RoomKey: &defs.RoomKey{}, Transport: mem, ABLoop: defs.ALoop},
+		mem:   mem,
+		sub:   mem.Subscribe(),
+	}
+	go o.RelayServ(r.room, r.relay)
+
+	probe := r.connect("probe")
+	r.send("probe", defs.Header{Ver: defs.FrameVersion, RelayCode: defs.FRAME_VERSION}, nil, nil)
+	r.recv(probe)
+	return r
+}
+
+// stop closes the transport and waits for the relay loop to return.
+func (r *testRoom) stop() {
+	r.mem.Close()
+	select {
+	case <-r.relay.Done:
+	case <-time.After(testTimeout):
+		r.t.Error("relay loop did not stop")
+	}
+}
+
+func (r *testRoom) connect(identity string) <-chan []byte {
+	return r.mem.Connect([]byte(identity))
+}
+
+func (r *testRoom) send(identity string, header defs.Header, destUids []defs.PlayerId, msg codec.Message) {
+	frame, err := codec.EncodeFrame(header, destUids, msg)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	err = r.mem.Request([]byte(identity), frame)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// recv returns the next frame of ch decoded.
+func (r *testRoom) recv(ch <-chan []byte) (defs.Header, []byte) {
+	r.t.Helper()
+	select {
+	case frame := <-ch:
+		header, _, content, err := codec.DecodeFrame(frame)
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		return header, content
+	case <-time.After(testTimeout):
+		r.t.Fatal("no frame received")
+	}
+	return defs.Header{}, nil
+}
+
+// recvCode skips frames of ch until a frame of code.
+func (r *testRoom) recvCode(ch <-chan []byte, code defs.RelayCode) (defs.Header, []byte) {
+	r.t.Helper()
+	for {
+		header, content := r.recv(ch)
+		if header.RelayCode == code {
+			return header, content
+		}
+	}
+}
+
+// recvError returns the next ERROR frame of ch decoded.
+func (r *testRoom) recvError(ch <-chan []byte) codec.Error {
+	r.t.Helper()
+	_, content := r.recvCode(ch, defs.ERROR)
+	rejected := codec.Error{}
+	err := rejected.Unmarshal(content)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return rejected
+}
+
+// join prepares seed and sends JOIN from identity in frame version ver.
+func (r *testRoom) join(identity string, ver byte, seed string) defs.PlayerId {
+	r.t.Helper()
+	content, err := r.o.JoinPrepareResponse(r.room, r.relay, []byte(seed))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	prepare := codec.JoinPrepare{}
+	err = prepare.Unmarshal(content)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.send(identity, defs.Header{Ver: ver, RelayCode: defs.JOIN, DestCode: defs.ALL, SrcUid: prepare.AssignUid}, nil, &codec.Join{Seed: []byte(seed), Name: []byte(identity)})
+	r.recvCode(r.sub, defs.JOIN)
+	return prepare.AssignUid
+}
+
+func TestFrameVersionNegotiation(t *testing.T) {
+	r := startTestRoom(t, newTestOpenRelay())
+	defer r.stop()
+	legacyPeer := r.connect("legacy")
+
+	r.send("legacy", defs.Header{Ver: defs.LegacyFrameVersion, RelayCode: defs.FRAME_VERSION}, nil, nil)
+	header, content := r.recv(legacyPeer)
+	negotiated := codec.FrameVersion{}
+	err := negotiated.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Ver != defs.LegacyFrameVersion || negotiated.Ver != defs.LegacyFrameVersion || negotiated.MinVer != defs.MinFrameVersion || negotiated.MaxVer != defs.FrameVersion {
+		t.Errorf("negotiated Ver %d %+v", header.Ver, negotiated)
+	}
+
+	uid := r.join("legacy", defs.LegacyFrameVersion, "legacy-seed")
+	header, _ = r.recvCode(legacyPeer, defs.JOIN)
+	if header.Ver != defs.LegacyFrameVersion || header.SrcUid != uid {
+		t.Errorf("join notice Ver %d uid %d, want %d %d", header.Ver, header.SrcUid, defs.LegacyFrameVersion, uid)
+	}
+
+	r.send("legacy", defs.Header{Ver: defs.MinFrameVersion - 1, RelayCode: defs.FRAME_VERSION}, nil, nil)
+	header, content = r.recv(legacyPeer)
+	rejected := codec.Error{}
+	err = rejected.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.RelayCode != defs.ERROR || rejected.Reason != defs.ERROR_UNSUPPORTED_VERSION {
+		t.Errorf("older frame answered code %d reason %d", header.RelayCode, rejected.Reason)
+	}
+}
+
+func TestJoinRelayLeave(t *testing.T) {
+	r := startTestRoom(t, newTestOpenRelay())
+	defer r.stop()
+	r.connect("a")
+	bPeer := r.connect("b")
+	aUid := r.join("a", defs.FrameVersion, "a-seed")
+	bUid := r.join("b", defs.FrameVersion, "b-seed")
+
+	r.send("a", defs.Header{Ver: defs.FrameVersion, RelayCode: defs.RELAY, DestCode: defs.ALL, SrcUid: aUid}, nil, &codec.Raw{Data: []byte("hello")})
+	header, content := r.recvCode(r.sub, defs.RELAY)
+	if header.SrcUid != aUid || string(content) != "hello" {
+		t.Errorf("relay uid %d content %q", header.SrcUid, content)
+	}
+
+	r.send("a", defs.Header{Ver: defs.FrameVersion, RelayCode: defs.LEAVE, DestCode: defs.ALL, SrcUid: aUid}, nil, &codec.Seed{Seed: []byte("a-seed")})
+	header, content = r.recvCode(r.sub, defs.LEAVE)
+	master := codec.Master{}
+	err := master.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.SrcUid != aUid || master.MasterUid != bUid {
+		t.Errorf("leave uid %d master %d, want %d %d", header.SrcUid, master.MasterUid, aUid, bUid)
+	}
+
+	r.send("b", defs.Header{Ver: defs.FrameVersion, RelayCode: defs.GET_USERS, SrcUid: bUid}, nil, nil)
+	_, content = r.recvCode(bPeer, defs.GET_USERS)
+	users := codec.Users{}
+	err = users.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users.Users) != 1 || users.Users[0].Uid != bUid {
+		t.Errorf("users after leave %+v", users.Users)
+	}
+}
+
+func TestSpoofedIdentity(t *testing.T) {
+	r := startTestRoom(t, newTestOpenRelay())
+	defer r.stop()
+	r.connect("a")
+	aUid := r.join("a", defs.FrameVersion, "a-seed")
+	content, err := r.o.JoinPrepareResponse(r.room, r.relay, []byte("c-seed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := codec.JoinPrepare{}
+	err = prepare.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cUid := prepare.AssignUid
+
+	tests := []struct {
+		name   string
+		header defs.Header
+		msg    codec.Message
+	}{
+		{"relay as another uid", defs.Header{RelayCode: defs.RELAY, DestCode: defs.ALL, SrcUid: aUid}, &codec.Raw{Data: []byte("spoofed")}},
+		{"get users as another uid", defs.Header{RelayCode: defs.GET_USERS, SrcUid: aUid}, nil},
+		{"join with a joined seed", defs.Header{RelayCode: defs.JOIN, DestCode: defs.ALL, SrcUid: aUid}, &codec.Join{Seed: []byte("a-seed")}},
+		{"join with the seed of another uid", defs.Header{RelayCode: defs.JOIN, DestCode: defs.ALL, SrcUid: aUid}, &codec.Join{Seed: []byte("c-seed")}},
+		{"join with an unknown seed", defs.Header{RelayCode: defs.JOIN, DestCode: defs.ALL, SrcUid: cUid}, &codec.Join{Seed: []byte("x-seed")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer := r.connect("mallory")
+			test.header.Ver = defs.FrameVersion
+			r.send("mallory", test.header, nil, test.msg)
+			rejected := r.recvError(peer)
+			if rejected.RelayCode != test.header.RelayCode || rejected.Reason != defs.ERROR_SPOOFED {
+				t.Errorf("rejected code %d reason %d, want %d %d", rejected.RelayCode, rejected.Reason, test.header.RelayCode, defs.ERROR_SPOOFED)
+			}
+		})
+	}
+}
+
+func TestDirectReplies(t *testing.T) {
+	r := startTestRoom(t, newTestOpenRelay())
+	defer r.stop()
+	aPeer := r.connect("a")
+	bPeer := r.connect("b")
+	aUid := r.join("a", defs.FrameVersion, "a-seed")
+	bUid := r.join("b", defs.FrameVersion, "b-seed")
+
+	tests := []struct {
+		code  defs.RelayCode
+		check func(content []byte) error
+	}{
+		{defs.GET_USERS, func(content []byte) error {
+			users := codec.Users{}
+			err := users.Unmarshal(content)
+			if err != nil {
+				return err
+			}
+			if users.MasterUid != aUid || len(users.Users) != 2 || users.Users[0].Uid != aUid || users.Users[1].Uid != bUid {
+				return fmt.Errorf("users %+v", users)
+			}
+			return nil
+		}},
+		{defs.GET_MASTER, func(content []byte) error {
+			master := codec.Master{}
+			err := master.Unmarshal(content)
+			if err != nil {
+				return err
+			}
+			if master.MasterUid != aUid {
+				return fmt.Errorf("master %d, want %d", master.MasterUid, aUid)
+			}
+			return nil
+		}},
+		{defs.GET_LEGACY_MAP, func(content []byte) error {
+			if len(content) != 0 {
+				return fmt.Errorf("legacy map %q, want empty", content)
+			}
+			return nil
+		}},
+		{defs.GET_SERVER_TIMESTAMP, func(content []byte) error {
+			timestamp := codec.ServerTimestamp{}
+			return timestamp.Unmarshal(content)
+		}},
+	}
+	for _, test := range tests {
+		r.send("a", defs.Header{Ver: defs.FrameVersion, RelayCode: test.code, SrcUid: aUid}, nil, nil)
+		header, content := r.recv(aPeer)
+		if header.RelayCode != test.code {
+			t.Errorf("code %d answered %d", test.code, header.RelayCode)
+			continue
+		}
+		err := test.check(content)
+		if err != nil {
+			t.Errorf("code %d: %v", test.code, err)
+		}
+		if len(bPeer) != 0 {
+			t.Errorf("code %d answered to another player", test.code)
+		}
+	}
+}
+
+func TestResend(t *testing.T) {
+	r := startTestRoom(t, newTestOpenRelay())
+	defer r.stop()
+	r.connect("a")
+	bPeer := r.connect("b")
+	aUid := r.join("a", defs.FrameVersion, "a-seed")
+	bUid := r.join("b", defs.FrameVersion, "b-seed")
+
+	seqs := []uint16{}
+	for _, data := range []string{"first", "second"} {
+		r.send("a", defs.Header{Ver: defs.FrameVersion, RelayCode: defs.RELAY, ContentCode: defs.CONTENT_RELIABLE, DestCode: defs.ALL, SrcUid: aUid}, nil, &codec.Raw{Data: []byte(data)})
+		header, _ := r.recvCode(r.sub, defs.RELAY)
+		seqs = append(seqs, header.Seq)
+	}
+	if seqs[0] == 0 || seqs[1] != seqs[0]+1 {
+		t.Fatalf("reliable frames sequenced %v", seqs)
+	}
+
+	r.send("b", defs.Header{Ver: defs.FrameVersion, RelayCode: defs.RESEND, SrcUid: bUid}, nil, &codec.Resend{FromSeq: seqs[0], ToSeq: seqs[1]})
+	for i, data := range []string{"first", "second"} {
+		header, content := r.recv(bPeer)
+		if header.RelayCode != defs.RELAY || header.Seq != seqs[i] || string(content) != data {
+			t.Errorf("resent code %d seq %d content %q", header.RelayCode, header.Seq, content)
+		}
+	}
+	_, content := r.recvCode(bPeer, defs.RESEND)
+	resend := codec.Resend{}
+	err := resend.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resend.FromSeq != seqs[0] || resend.ToSeq != seqs[1] {
+		t.Errorf("resend answered %+v", resend)
+	}
+}
+
+// connectStateless registers identity as a dtls deal authenticated with seed, and returns the channel of frames sent to it.
+func (r *testRoom) connectStateless(identity string, seed string) <-chan []byte {
+	server, client := net.Pipe()
+	peer := make(chan []byte, 64)
+	go func() {
+		buf := make([]byte, math.MaxUint16)
+		for {
+			n, err := client.Read(buf)
+			if err != nil {
+				return
+			}
+			peer <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	added := make(chan struct{})
+	post(r.relay, func() {
+		if r.relay.Stl == nil {
+			r.relay.Stl = defs.NewStatelessConns()
+		}
+		r.relay.Stl.AddDeal([]byte(identity), []byte(seed), server)
+		close(added)
+	})
+	<-added
+	return peer
+}
+
+func TestStatelessSeedBound(t *testing.T) {
+	r := startTestRoom(t, newTestOpenRelay())
+	defer r.stop()
+	content, err := r.o.JoinPrepareResponse(r.room, r.relay, []byte("a-seed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := codec.JoinPrepare{}
+	err = prepare.Unmarshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := defs.Header{Ver: defs.FrameVersion, RelayCode: defs.JOIN, DestCode: defs.ALL, SrcUid: prepare.AssignUid}
+
+	other := r.connectStateless(defs.StatelessIdentityPrefix+"other", "b-seed")
+	r.send(defs.StatelessIdentityPrefix+"other", join, nil, &codec.Join{Seed: []byte("a-seed")})
+	rejected := r.recvError(other)
+	if rejected.Reason != defs.ERROR_SPOOFED {
+		t.Errorf("join with another seed rejected reason %d", rejected.Reason)
+	}
+
+	r.connectStateless(defs.StatelessIdentityPrefix+"owner", "a-seed")
+	r.send(defs.StatelessIdentityPrefix+"owner", join, nil, &codec.Join{Seed: []byte("a-seed")})
+	header, _ := r.recvCode(r.sub, defs.JOIN)
+	if header.SrcUid != prepare.AssignUid {
+		t.Errorf("joined uid %d, want %d", header.SrcUid, prepare.AssignUid)
+	}
+}
@@ -0,0 +1,50 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"math"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"sort"
+	"time"
+)
+
+// users returns the room roster ordered by uid.
+func (o *OpenRelay) users(relay *defs.RoomInstance) *codec.Users {
+	uids := []defs.PlayerId{}
+	for uid := range relay.Uids {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	users := &codec.Users{MasterUid: relay.MasterUid, Users: []codec.User{}}
+	now := time.Now().Unix()
+	for _, uid := range uids {
+		state := defs.USER_STATE_CONNECTED
+		last, ok := relay.Hbs[uid]
+		if !ok {
+			state = defs.USER_STATE_WAIT_REJOIN
+			last = relay.Dcs[uid]
+		}
+		hbAge := uint16(math.MaxUint16)
+		if age := now - last; age < math.MaxUint16 {
+			hbAge = uint16(age)
+		}
+		users.Users = append(users.Users, codec.User{Uid: uid, HbAge: hbAge, State: state, Name: []byte(relay.Names[uid])})
+	}
+	return users
+}
@@ -0,0 +1,265 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"time"
+)
+
+// touch refreshes the heatbeat of uid, and reports whether uid is a connected player.
+func touch(relay *defs.RoomInstance, uid defs.PlayerId) bool {
+	if _, ok := relay.Hbs[uid]; !ok {
+		relay.Log.Println(defs.NOTICE, "source uid is invalid ", uid)
+		return false
+	}
+	relay.Hbs[uid] = time.Now().Unix()
+	return true
+}
+
+// verified reports whether identity is bound to header.SrcUid at JOIN.
+// JOIN, REJOIN and REPLAY_JOIN bind identities by join seed, CONNECT and FRAME_VERSION carry no uid.
+func verified(relay *defs.RoomInstance, header defs.Header, identity []byte) bool {
+	switch header.RelayCode {
+	case defs.CONNECT, defs.FRAME_VERSION, defs.JOIN, defs.REJOIN, defs.REPLAY_JOIN:
+		return true
+	}
+	bound, ok := relay.Identities[header.SrcUid]
+	if !ok {
+		// lobby maps are shared before join.
+		return header.RelayCode == defs.SET_LOBBY_MAP || header.RelayCode == defs.GET_LOBBY_MAP
+	}
+	return bytes.Equal(bound, identity)
+}
+
+func rejectSpoof(relay *defs.RoomInstance, header defs.Header, identity []byte) {
+	relay.SpoofCount++
+	relay.Log.Printf(defs.NOTICE, "spoofed frame rejected, code:%d uid:%d identity:%s count:%d", header.RelayCode, header.SrcUid, hex.EncodeToString(identity), relay.SpoofCount)
+}
+
+func containsUid(uids []defs.PlayerId, uid defs.PlayerId) bool {
+	for _, value := range uids {
+		if value == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// sendTo converts frame to the negotiated version of uid.
+func (o *OpenRelay) sendTo(relay *defs.RoomInstance, uid defs.PlayerId, frame []byte) error {
+	identity, ok := relay.Identities[uid]
+	if !ok {
+		return fmt.Errorf("identity not found, uid %d", uid)
+	}
+	if ver, ok := relay.Vers[uid]; ok {
+		var err error
+		frame, err = codec.Downgrade(frame, ver)
+		if err != nil {
+			return err
+		}
+	}
+	return route(relay, identity, frame)
+}
+
+// publish stamps the room sequence and publishes frame,
+// players of an older frame version also get it downgraded point to point, they drop the published one by its Ver.
+func (o *OpenRelay) publish(relay *defs.RoomInstance, frame []byte) error {
+	frame = o.sequence(relay, frame)
+	err := broadcast(relay, frame)
+	for uid, ver := range relay.Vers {
+		if ver == defs.FrameVersion {
+			continue
+		}
+		sendErr := o.sendTo(relay, uid, frame)
+		if sendErr != nil {
+			relay.Log.Println(defs.NOTICE, "send failed. ", sendErr)
+		}
+	}
+	return err
+}
+
+// route sends frame to identity through the room transport, its websocket, or its dtls connection on stateless rooms.
+func route(relay *defs.RoomInstance, identity []byte, frame []byte) error {
+	if relay.Stl != nil && defs.IsStatelessIdentity(identity) {
+		conn, ok := relay.Stl.Deal(identity)
+		if !ok {
+			return fmt.Errorf("stateless connection not found, identity %s", identity)
+		}
+		_, err := conn.Write(frame)
+		return err
+	}
+	if relay.Gateway != nil && defs.IsGatewayIdentity(identity) {
+		return relay.Gateway.Send(identity, frame)
+	}
+	return relay.Transport.Send(identity, frame)
+}
+
+// broadcast publishes frame to the room transport, websocket peers and dtls sub connections.
+func broadcast(relay *defs.RoomInstance, frame []byte) error {
+	err := relay.Transport.Publish(frame)
+	if relay.Gateway != nil {
+		relay.Gateway.Publish(frame)
+	}
+	if relay.Stl == nil {
+		return err
+	}
+	for _, conn := range relay.Stl.Subs() {
+		_, stlErr := conn.Write(frame)
+		if stlErr != nil {
+			relay.Log.Println(defs.NOTICE, "stateless send failed. ", stlErr)
+		}
+	}
+	return err
+}
+
+// reply answers the requester identity directly in frame version ver, for requesters not joined yet.
+func (o *OpenRelay) reply(relay *defs.RoomInstance, identity []byte, ver byte, header defs.Header, msg codec.Message) error {
+	frame, err := codec.EncodeFrame(header, nil, msg)
+	if err != nil {
+		return err
+	}
+	if ver != 0 {
+		frame, err = codec.Downgrade(frame, ver)
+		if err != nil {
+			return err
+		}
+	}
+	return route(relay, identity, frame)
+}
+
+// replyFrameVersion tells identity the negotiated frame version, ver 0 means unsupported.
+func (o *OpenRelay) replyFrameVersion(relay *defs.RoomInstance, identity []byte, ver byte) {
+	header := defs.Header{Ver: defs.FrameVersion, RelayCode: defs.FRAME_VERSION}
+	err := o.reply(relay, identity, ver, header, &codec.FrameVersion{Ver: ver, MinVer: o.MinFrameVersion, MaxVer: defs.FrameVersion})
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+	}
+}
+
+// reject tells identity why its frame was dropped, header is the rejected header as far as it was decoded.
+func (o *OpenRelay) reject(relay *defs.RoomInstance, identity []byte, ver byte, header defs.Header, reason defs.ErrorReason) {
+	if !codec.Accepts(ver, o.MinFrameVersion) {
+		ver = 0
+	}
+	replyHeader := defs.Header{Ver: defs.FrameVersion, RelayCode: defs.ERROR, SrcUid: header.SrcUid, SrcOid: header.SrcOid}
+	err := o.reply(relay, identity, ver, replyHeader, &codec.Error{RelayCode: header.RelayCode, Reason: reason})
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "frame send failed. ", err)
+	}
+}
+
+// oversized reports whether header lengths exceed the limits, checked before any read of dest uids or content.
+func (o *OpenRelay) oversized(room *defs.RoomParameter, header defs.Header) bool {
+	if o.ContentMax < int(header.ContentLen) {
+		return true
+	}
+	return 0 < room.Capacity && 2*int(room.Capacity) < int(header.DestLen)
+}
+
+func (o *OpenRelay) sendMessage(relay *defs.RoomInstance, uid defs.PlayerId, header defs.Header, msg codec.Message) error {
+	frame, err := codec.EncodeFrame(header, nil, msg)
+	if err != nil {
+		return err
+	}
+	return o.sendTo(relay, uid, frame)
+}
+
+func (o *OpenRelay) publishMessage(relay *defs.RoomInstance, header defs.Header, msg codec.Message) error {
+	frame, err := codec.EncodeFrame(header, nil, msg)
+	if err != nil {
+		return err
+	}
+	return o.publish(relay, frame)
+}
+
+// subscribes reports whether uid accepts frames with mask, mask 0 is delivered to everyone.
+func subscribes(relay *defs.RoomInstance, uid defs.PlayerId, mask byte) bool {
+	if mask == 0 {
+		return true
+	}
+	playerMask, ok := relay.Masks[uid]
+	if !ok {
+		playerMask = defs.MASK_ALL
+	}
+	return playerMask&mask != 0
+}
+
+func maskFiltered(relay *defs.RoomInstance, mask byte) bool {
+	for uid := range relay.Hbs {
+		if !subscribes(relay, uid, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// OTHERS and ALL are published to the room, receivers drop their own frames on OTHERS.
+// when some player masks out the frame, OTHERS and ALL fall back to point to point without sequence.
+// MASTER, INCLUDE and EXCLUDE are sent point to point so that nobody else can subscribe them.
+func (o *OpenRelay) deliver(relay *defs.RoomInstance, header defs.Header, destUids []defs.PlayerId, frame []byte) error {
+	switch header.DestCode {
+	case defs.OTHERS, defs.ALL:
+		if !maskFiltered(relay, header.Mask) {
+			return o.publish(relay, frame)
+		}
+		for uid := range relay.Hbs {
+			if header.DestCode == defs.OTHERS && uid == header.SrcUid {
+				continue
+			}
+			o.sendMasked(relay, uid, header.Mask, frame)
+		}
+		return nil
+	case defs.MASTER:
+		if !subscribes(relay, relay.MasterUid, header.Mask) {
+			return nil
+		}
+		return o.sendTo(relay, relay.MasterUid, frame)
+	case defs.INCLUDE:
+		for _, uid := range destUids {
+			if _, ok := relay.Hbs[uid]; !ok {
+				relay.Log.Println(defs.NOTICE, "dest uid is invalid ", uid)
+				continue
+			}
+			o.sendMasked(relay, uid, header.Mask, frame)
+		}
+		return nil
+	case defs.EXCLUDE:
+		for uid := range relay.Hbs {
+			if containsUid(destUids, uid) {
+				continue
+			}
+			o.sendMasked(relay, uid, header.Mask, frame)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid DestCode %d", header.DestCode)
+	}
+}
+
+func (o *OpenRelay) sendMasked(relay *defs.RoomInstance, uid defs.PlayerId, mask byte, frame []byte) {
+	if !subscribes(relay, uid, mask) {
+		return
+	}
+	err := o.sendTo(relay, uid, frame)
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "send failed. ", err)
+	}
+}
@@ -0,0 +1,132 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"crypto/rand"
+	"errors"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSessionsFull = errors.New("sessions are full")
+
+type session struct {
+	secret   []byte
+	lastSeen int64 // unix sec, atomic
+}
+
+// Sessions holds the session secrets issued at logon, shared by the entry and relay services.
+// a session expires ttl sec after its last use, at most max sessions are kept, 0=unlimited.
+type Sessions struct {
+	mu       sync.RWMutex
+	sessions map[[codec.SessionIdSize]byte]*session
+	ttl      int64
+	max      int
+}
+
+func NewSessions(ttl int, max int) *Sessions {
+	return &Sessions{sessions: make(map[[codec.SessionIdSize]byte]*session), ttl: int64(ttl), max: max}
+}
+
+// Issue creates a new session id and secret, expired sessions are swept when the sessions are full.
+func (s *Sessions) Issue() (defs.LogonResponse, error) {
+	res := defs.LogonResponse{}
+	_, err := rand.Read(res.SessionId[:])
+	if err != nil {
+		return res, err
+	}
+	_, err = rand.Read(res.Secret[:])
+	if err != nil {
+		return res, err
+	}
+	now := time.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if 0 < s.max && s.max <= len(s.sessions) {
+		s.sweep(now)
+	}
+	if 0 < s.max && s.max <= len(s.sessions) {
+		return res, ErrSessionsFull
+	}
+	s.sessions[res.SessionId] = &session{secret: res.Secret[:], lastSeen: now}
+	return res, nil
+}
+
+// Secret returns the secret of sessionId and extends its expiry.
+func (s *Sessions) Secret(sessionId [codec.SessionIdSize]byte) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.sessions[sessionId]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now().Unix()
+	if s.expired(entry, now) {
+		return nil, false
+	}
+	atomic.StoreInt64(&entry.lastSeen, now)
+	return entry.secret, true
+}
+
+func (s *Sessions) Revoke(sessionId [codec.SessionIdSize]byte) {
+	s.mu.Lock()
+	delete(s.sessions, sessionId)
+	s.mu.Unlock()
+}
+
+// Sweep drops expired sessions.
+func (s *Sessions) Sweep() {
+	s.mu.Lock()
+	s.sweep(time.Now().Unix())
+	s.mu.Unlock()
+}
+
+func (s *Sessions) sweep(now int64) {
+	for sessionId, entry := range s.sessions {
+		if s.expired(entry, now) {
+			delete(s.sessions, sessionId)
+		}
+	}
+}
+
+func (s *Sessions) expired(entry *session, now int64) bool {
+	return 0 < s.ttl && atomic.LoadInt64(&entry.lastSeen)+s.ttl < now
+}
+
+// sweepSessions drops expired sessions every minute.
+func (o *OpenRelay) sweepSessions() {
+	for {
+		time.Sleep(time.Minute)
+		o.Sessions.Sweep()
+	}
+}
+
+// sessionBound reports whether the uid of header joined with sessionId.
+func sessionBound(relay *defs.RoomInstance, header defs.Header, sessionId [codec.SessionIdSize]byte) bool {
+	switch header.RelayCode {
+	case defs.CONNECT, defs.FRAME_VERSION, defs.JOIN, defs.REJOIN, defs.REPLAY_JOIN:
+		return true
+	}
+	bound, ok := relay.SessionIds[header.SrcUid]
+	if !ok {
+		return header.RelayCode == defs.SET_LOBBY_MAP || header.RelayCode == defs.GET_LOBBY_MAP
+	}
+	return bound == sessionId
+}
@@ -0,0 +1,53 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"math"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+)
+
+// pushStack appends content and returns its absolute index.
+// when the stack exceeds StackMax, the oldest messages are dropped and StackHead moves forward.
+func (o *OpenRelay) pushStack(relay *defs.RoomInstance, content []byte) uint32 {
+	index := relay.StackHead + uint32(len(relay.Stack))
+	relay.Stack = append(relay.Stack, content)
+	if over := len(relay.Stack) - o.StackMax; 0 < o.StackMax && 0 < over {
+		relay.Stack = relay.Stack[over:]
+		relay.StackHead += uint32(over)
+	}
+	return index
+}
+
+// fetchStack returns stacked messages from fromIndex,
+// messages that would overflow ContentLen are left for the next fetch.
+func (o *OpenRelay) fetchStack(relay *defs.RoomInstance, fromIndex uint32) *codec.StackEntries {
+	if fromIndex < relay.StackHead {
+		fromIndex = relay.StackHead
+	}
+	entries := &codec.StackEntries{FirstIndex: fromIndex, Entries: [][]byte{}}
+	contentLen := codec.StackEntriesHeaderSize
+	for index := fromIndex - relay.StackHead; index < uint32(len(relay.Stack)); index++ {
+		entryLen := codec.StackEntrySize(len(relay.Stack[index]))
+		if math.MaxUint16 < contentLen+entryLen {
+			break
+		}
+		contentLen += entryLen
+		entries.Entries = append(entries.Entries, relay.Stack[index])
+	}
+	return entries
+}
@@ -0,0 +1,208 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"bytes"
+	"errors"
+	"github.com/pion/dtls"
+	"math"
+	"net"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	"time"
+)
+
+const statelessSeedMax = 256
+
+// statelessPSK accepts psk identities of join seeds, see codec.StatelessKey.
+// every connection handshakes with its own statelessPSK, seed is the identity it authenticated with
+// once dtls.Server returns.
+type statelessPSK struct {
+	relay *defs.RoomInstance
+	seed  []byte
+}
+
+func (p *statelessPSK) key(identity []byte) ([]byte, error) {
+	if len(identity) == 0 || statelessSeedMax < len(identity) {
+		return nil, errors.New("invalid psk identity")
+	}
+	roomKey := p.relay.RoomKey.Get()
+	if len(roomKey) == 0 {
+		return nil, errors.New("room key is not created")
+	}
+	p.seed = append([]byte{}, identity...)
+	return codec.StatelessKey(roomKey, identity), nil
+}
+
+func (o *OpenRelay) statelessConfig(psk *statelessPSK) *dtls.Config {
+	return &dtls.Config{
+		PSK:            psk.key,
+		CipherSuites:   []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+		ConnectTimeout: dtls.ConnectTimeoutOption(time.Duration(o.JoinTimeout) * time.Second),
+	}
+}
+
+// StatelessServ accepts dtls clients on the stateless ports of room, one frame per datagram as the zeromq path.
+// deal frames are queued to inbox as router requests, sub connections receive published frames.
+// the listeners are closed when the relay loop returns.
+func (o *OpenRelay) StatelessServ(room *defs.RoomParameter, relay *defs.RoomInstance, inbox chan<- [][]byte) {
+	dealAddr, err := net.ResolveUDPAddr(o.bindNetwork(o.StlDealProto), o.bindAddr(o.StlDealHost, room.StlDealPort))
+	if err != nil {
+		relay.Log.Panic("stateless deal resolve failed. ", o.StlDealProto, o.StlDealHost, room.StlDealPort, err)
+	}
+	deal, err := listenUDP(o.bindNetwork(o.StlDealProto), dealAddr)
+	if err != nil {
+		relay.Log.Panic("stateless deal listen failed. ", o.StlDealProto, o.StlDealHost, room.StlDealPort, err)
+	}
+	defer deal.Close()
+	subAddr, err := net.ResolveUDPAddr(o.bindNetwork(o.StlSubProto), o.bindAddr(o.StlSubHost, room.StlSubPort))
+	if err != nil {
+		relay.Log.Panic("stateless sub resolve failed. ", o.StlSubProto, o.StlSubHost, room.StlSubPort, err)
+	}
+	sub, err := listenUDP(o.bindNetwork(o.StlSubProto), subAddr)
+	if err != nil {
+		relay.Log.Panic("stateless sub listen failed. ", o.StlSubProto, o.StlSubHost, room.StlSubPort, err)
+	}
+	defer sub.Close()
+
+	relay.Log.Println(defs.VERBOSE, "start stateless relay: ", room.StlDealPort, room.StlSubPort)
+
+	go o.acceptStateless(relay, sub, func(seed []byte, conn net.Conn) {
+		o.readStatelessSub(relay, seed, conn)
+	})
+	go o.acceptStateless(relay, deal, func(seed []byte, conn net.Conn) {
+		identity := defs.StatelessIdentity(conn.RemoteAddr())
+		relay.Stl.AddDeal(identity, seed, conn)
+		o.readStatelessDeal(relay, identity, conn, inbox)
+	})
+	<-relay.Done
+}
+
+// acceptStateless handshakes every new remote address of listener, and serves it with the join seed it authenticated with.
+func (o *OpenRelay) acceptStateless(relay *defs.RoomInstance, listener *udpMux, serve func(seed []byte, conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			psk := &statelessPSK{relay: relay}
+			dtlsConn, err := dtls.Server(conn, o.statelessConfig(psk))
+			if err != nil {
+				if !statelessDone(relay) {
+					relay.Log.Println(defs.NOTICE, "stateless handshake failed. ", conn.RemoteAddr(), err)
+				}
+				conn.Close()
+				return
+			}
+			serve(psk.seed, dtlsConn)
+		}()
+	}
+}
+
+// statelessDone reports whether the relay loop returned, handshake errors after it are of closed listeners.
+func statelessDone(relay *defs.RoomInstance) bool {
+	select {
+	case <-relay.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// statelessBound reports whether identity may join with seed,
+// dtls deals join only with the seed of their psk identity, so that a deal cannot take the uid of another seed.
+func statelessBound(relay *defs.RoomInstance, identity []byte, seed []byte) bool {
+	if !defs.IsStatelessIdentity(identity) {
+		return true
+	}
+	if relay.Stl == nil {
+		return false
+	}
+	dealSeed, ok := relay.Stl.DealSeed(identity)
+	return ok && bytes.Equal(dealSeed, seed)
+}
+
+// readStatelessDeal forwards frames of conn as router requests of identity,
+// frames are dropped while the relay loop is behind as datagrams are.
+func (o *OpenRelay) readStatelessDeal(relay *defs.RoomInstance, identity []byte, conn net.Conn, inbox chan<- [][]byte) {
+	defer relay.Stl.RemoveDeal(identity, conn)
+	buf := make([]byte, math.MaxUint16)
+	for {
+		if 0 < o.HeatbeatTimeout {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(o.HeatbeatTimeout) * time.Second))
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			relay.Log.Println(defs.VERBOSE, "stateless deal closed. ", string(identity), err)
+			return
+		}
+		frame := make([]byte, n)
+		copy(frame, buf[:n])
+		select {
+		case inbox <- [][]byte{identity, frame}:
+		default:
+			relay.Log.Println(defs.NOTICE, "stateless inbox is full, frame dropped. ", string(identity))
+		}
+	}
+}
+
+// readStatelessSub registers conn by seed, the psk identity it authenticated with,
+// once the relay loop finds seed joined. datagrams of conn are keepalives and dropped.
+func (o *OpenRelay) readStatelessSub(relay *defs.RoomInstance, seed []byte, conn net.Conn) {
+	joined := make(chan bool, 1)
+	post(relay, func() {
+		_, ok := relay.Guids[string(seed)]
+		if ok {
+			relay.Stl.AddSub(seed, conn)
+		}
+		joined <- ok
+	})
+	select {
+	case ok := <-joined:
+		if !ok {
+			relay.Log.Println(defs.NOTICE, "stateless sub seed is not joined.")
+			conn.Close()
+			return
+		}
+	case <-relay.Done:
+		conn.Close()
+		return
+	}
+	defer relay.Stl.RemoveSub(seed, conn)
+	buf := make([]byte, statelessSeedMax)
+	for {
+		_, err := conn.Read(buf)
+		if err != nil {
+			relay.Log.Println(defs.VERBOSE, "stateless sub closed. ", err)
+			return
+		}
+	}
+}
+
+// dropStateless closes the dtls connections of uid, called before its identity and seed are forgotten.
+func dropStateless(relay *defs.RoomInstance, uid defs.PlayerId) {
+	if relay.Stl == nil {
+		return
+	}
+	if identity, ok := relay.Identities[uid]; ok && defs.IsStatelessIdentity(identity) {
+		relay.Stl.RemoveDeal(identity, nil)
+	}
+	if seed, ok := relay.Uids[uid]; ok {
+		relay.Stl.RemoveSub([]byte(seed), nil)
+	}
+}
@@ -0,0 +1,96 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+)
+
+// trackStream checks a RELAY_STREAM chunk against the stream state of the source uid,
+// and reports whether the chunk should be relayed.
+// broken streams (lost chunk, over StreamMax) are cancelled for the sender and the receivers.
+// sealed chunks are relayed untracked, their StreamHeader is inside the ciphertext.
+func (o *OpenRelay) trackStream(relay *defs.RoomInstance, header defs.Header, destUids []defs.PlayerId, content []byte) bool {
+	if header.ContentCode&defs.CONTENT_SEALED != 0 {
+		return true
+	}
+	chunk := codec.StreamChunk{}
+	err := chunk.Unmarshal(content)
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "binary read failed. ", err)
+		return false
+	}
+	streamHeader := chunk.StreamHeader
+	key := defs.StreamKey{Uid: header.SrcUid, StreamId: streamHeader.StreamId}
+	if streamHeader.Flags&defs.STREAM_CANCEL != 0 {
+		delete(relay.Streams, key)
+		relay.Log.Printf(defs.VERBOSE, "stream cancelled by sender uid:%d stream:%d", key.Uid, key.StreamId)
+		return true
+	}
+
+	state, ok := relay.Streams[key]
+	if streamHeader.ChunkIndex == 0 {
+		state = defs.StreamState{}
+	} else if !ok || streamHeader.ChunkIndex != state.NextIndex {
+		relay.Log.Printf(defs.NOTICE, "stream chunk lost uid:%d stream:%d chunk:%d expected:%d", key.Uid, key.StreamId, streamHeader.ChunkIndex, state.NextIndex)
+		o.cancelStream(relay, header, destUids, key)
+		return false
+	}
+	state.NextIndex = streamHeader.ChunkIndex + 1
+	state.Size += len(chunk.Data)
+	if 0 < o.StreamMax && o.StreamMax < state.Size {
+		relay.Log.Printf(defs.NOTICE, "stream size over uid:%d stream:%d size:%d max:%d", key.Uid, key.StreamId, state.Size, o.StreamMax)
+		o.cancelStream(relay, header, destUids, key)
+		return false
+	}
+	if streamHeader.Flags&defs.STREAM_FINAL != 0 {
+		delete(relay.Streams, key)
+	} else {
+		relay.Streams[key] = state
+	}
+	return true
+}
+
+func (o *OpenRelay) cancelStream(relay *defs.RoomInstance, header defs.Header, destUids []defs.PlayerId, key defs.StreamKey) {
+	delete(relay.Streams, key)
+
+	cancel := codec.StreamChunk{StreamHeader: defs.StreamHeader{StreamId: key.StreamId, Flags: defs.STREAM_CANCEL}}
+	frame, err := codec.EncodeFrame(header, nil, &cancel)
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "binary write failed. ", err)
+		return
+	}
+	err = o.deliver(relay, header, destUids, frame)
+	if err != nil {
+		relay.Log.Println(defs.NOTICE, "send failed. ", err)
+	}
+	// cancel is idempotent, the sender may receive it twice on INCLUDE or EXCLUDE.
+	if header.DestCode != defs.ALL {
+		err = o.sendTo(relay, header.SrcUid, frame)
+		if err != nil {
+			relay.Log.Println(defs.NOTICE, "send failed. ", err)
+		}
+	}
+}
+
+func (o *OpenRelay) dropStreams(relay *defs.RoomInstance, uid defs.PlayerId) {
+	for key := range relay.Streams {
+		if key.Uid == uid {
+			delete(relay.Streams, key)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"bytes"
+	"openrelay/internal/defs"
+)
+
+const taskSize = 64
+
+// loopWake is queued to the inbox to wake the relay loop for posted tasks,
+// peers never send it since every peer request carries identity and frame.
+var loopWake = [][]byte{[]byte("wake")}
+
+func isLoopWake(request [][]byte) bool {
+	return len(request) == 1 && bytes.Equal(request[0], loopWake[0])
+}
+
+// post runs task in the relay loop of the room, so that task may touch the room state.
+// task is dropped when the room is stopped.
+func post(relay *defs.RoomInstance, task func()) {
+	select {
+	case relay.Tasks <- task:
+	case <-relay.Done:
+		return
+	}
+	select {
+	case relay.Inbox <- loopWake:
+	default:
+		// the loop is woken by the queued requests.
+	}
+}
+
+// runTasks runs the tasks posted until now, called from the relay loop after each receive.
+func runTasks(relay *defs.RoomInstance) {
+	for {
+		select {
+		case task := <-relay.Tasks:
+			task()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zeromq/goczmq"
+	"math"
+	"openrelay/internal/codec"
+	"openrelay/internal/defs"
+	relaynet "openrelay/internal/net"
+)
+
+const tcpQueueSize = 1024
+const inboxSize = 1024
+
+// inboxEndpoint is the inproc endpoint forwarding dtls and websocket requests into the zeromq relay loop of a room.
+func inboxEndpoint(roomIdHexStr string) string {
+	return "inproc://inbox-" + roomIdHexStr
+}
+
+// ParseTransport reads a transport name of the -transport flag.
+func ParseTransport(name string) (byte, error) {
+	switch name {
+	case "zmq":
+		return defs.TRANSPORT_ZMQ, nil
+	case "tcp":
+		return defs.TRANSPORT_TCP, nil
+	default:
+		return 0, fmt.Errorf("unknown transport %s", name)
+	}
+}
+
+// newTransport binds the statefull ports of room, requests of dtls and websocket peers in inbox are received with the rest.
+func (o *OpenRelay) newTransport(room *defs.RoomParameter, relay *defs.RoomInstance, roomIdHexStr string, inbox <-chan [][]byte) (defs.Transport, error) {
+	switch room.Transport {
+	case defs.TRANSPORT_TCP:
+		return newTcpTransport(o.bindNetwork(o.StfDealProto), o.bindAddr(o.StfDealHost, room.StfDealPort), o.bindAddr(o.StfSubHost, room.StfSubPort), o.tcpFrameMax(), inbox)
+	default:
+		dealEndpoint := o.zmqEndpoint(o.StfDealProto, o.StfDealHost, room.StfDealPort)
+		subEndpoint := o.zmqEndpoint(o.StfSubProto, o.StfSubHost, room.StfSubPort)
+		return newZmqTransport(relay.Log, dealEndpoint, subEndpoint, o.listensIpv6(), inbox, inboxEndpoint(roomIdHexStr))
+	}
+}
+
+// zmqTransport is the goczmq router and pub pair of a room.
+type zmqTransport struct {
+	logger *defs.Logger
+	router *goczmq.Sock
+	pub    *goczmq.Sock
+	pull   *goczmq.Sock
+	poller *goczmq.Poller
+}
+
+// newZmqTransport binds router and pub, ipv6 enables ipv6 before bind.
+// inbox is pushed to inboxEndpoint and polled with the router so that every socket stays in one goroutine.
+func newZmqTransport(logger *defs.Logger, dealEndpoint string, subEndpoint string, ipv6 bool, inbox <-chan [][]byte, inboxEndpoint string) (*zmqTransport, error) {
+	t := &zmqTransport{logger: logger}
+	var err error
+	t.router, err = bindZmq(goczmq.Router, dealEndpoint, ipv6)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("router %s, %v", dealEndpoint, err)
+	}
+	t.pub, err = bindZmq(goczmq.Pub, subEndpoint, ipv6)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("pub %s, %v", subEndpoint, err)
+	}
+	t.poller, err = goczmq.NewPoller(t.router)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("poller %s, %v", dealEndpoint, err)
+	}
+	if inbox == nil {
+		return t, nil
+	}
+	t.pull, err = goczmq.NewPull(inboxEndpoint)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("pull %s, %v", inboxEndpoint, err)
+	}
+	err = t.poller.Add(t.pull)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("poll %s, %v", inboxEndpoint, err)
+	}
+	go forwardInbox(logger, inbox, inboxEndpoint)
+	return t, nil
+}
+
+func bindZmq(sockType int, endpoint string, ipv6 bool) (*goczmq.Sock, error) {
+	sock := goczmq.NewSock(sockType)
+	if ipv6 {
+		sock.SetIpv6(1)
+	}
+	err := sock.Attach(endpoint, true)
+	if err != nil {
+		sock.Destroy()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// Recv drops router requests of identities reserved for dtls and websocket peers,
+// zeromq clients may choose their routing id and would be routed as those peers otherwise.
+func (t *zmqTransport) Recv() ([][]byte, error) {
+	for {
+		sock := t.poller.Wait(-1)
+		if sock == nil {
+			return nil, errors.New("relay poller wait interrupted")
+		}
+		request, err := sock.RecvMessage()
+		if err == nil && sock == t.router && 0 < len(request) && reservedIdentity(request[0]) {
+			t.logger.Println(defs.NOTICE, "reserved identity request dropped. ", string(request[0]))
+			continue
+		}
+		return request, err
+	}
+}
+
+func reservedIdentity(identity []byte) bool {
+	return defs.IsGatewayIdentity(identity) || defs.IsStatelessIdentity(identity)
+}
+
+func (t *zmqTransport) Send(identity []byte, frame []byte) error {
+	return t.router.SendMessage([][]byte{identity, frame})
+}
+
+func (t *zmqTransport) Publish(frame []byte) error {
+	return t.pub.SendFrame(frame, goczmq.FlagNone)
+}
+
+func (t *zmqTransport) Close() {
+	if t.poller != nil {
+		t.poller.Destroy()
+	}
+	if t.pull != nil {
+		t.pull.Destroy()
+	}
+	if t.pub != nil {
+		t.pub.Destroy()
+	}
+	if t.router != nil {
+		t.router.Destroy()
+	}
+}
+
+// forwardInbox pushes inbox to endpoint polled by the zeromq transport.
+func forwardInbox(logger *defs.Logger, inbox <-chan [][]byte, endpoint string) {
+	push, err := goczmq.NewPush(endpoint)
+	if err != nil {
+		logger.Panic("inbox push create failed. "+endpoint, err)
+	}
+	defer push.Destroy()
+	for request := range inbox {
+		err = push.SendMessage(request)
+		if err != nil {
+			logger.Println(defs.NOTICE, "inbox push failed. ", err)
+		}
+	}
+}
+
+// tcpTransport is the cgo free transport of internal/net.
+type tcpTransport struct {
+	server *relaynet.Server
+	inbox  <-chan [][]byte
+}
+
+func newTcpTransport(proto string, dealAddr string, subAddr string, frameMax int, inbox <-chan [][]byte) (*tcpTransport, error) {
+	server, err := relaynet.Listen(proto, dealAddr, subAddr, tcpQueueSize, frameMax)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpTransport{server: server, inbox: inbox}, nil
+}
+
+// Recv waits tcp requests, and dtls and websocket requests in inbox.
+func (t *tcpTransport) Recv() ([][]byte, error) {
+	select {
+	case request := <-t.server.Requests():
+		return request, nil
+	case request := <-t.inbox:
+		return request, nil
+	}
+}
+
+func (t *tcpTransport) Send(identity []byte, frame []byte) error {
+	return t.server.Send(identity, frame)
+}
+
+func (t *tcpTransport) Publish(frame []byte) error {
+	return t.server.Broadcast(frame)
+}
+
+func (t *tcpTransport) Close() {
+	t.server.Close()
+}
+
+// tcpFrameMax is the largest frame a tcp client may send, header, dest uids up to DestLen, content and trailer.
+func (o *OpenRelay) tcpFrameMax() int {
+	return codec.HeaderSize + math.MaxUint16 + 3 + o.ContentMax + codec.TrailerSize
+}
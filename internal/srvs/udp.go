@@ -0,0 +1,225 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpAcceptMax is the most new remote addresses waiting accept, datagrams of more are dropped.
+const udpAcceptMax = 64
+
+// udpQueueSize is the most datagrams waiting read per remote address, newer ones are dropped.
+const udpQueueSize = 64
+
+var ErrUDPClosed = errors.New("udp connection is closed")
+
+// udpTimeout is returned by reads past the read deadline.
+type udpTimeout struct{}
+
+func (udpTimeout) Error() string   { return "udp read timeout" }
+func (udpTimeout) Timeout() bool   { return true }
+func (udpTimeout) Temporary() bool { return true }
+
+// udpMux splits the datagrams of one udp socket into a connection per remote address,
+// so that every connection runs its own dtls handshake with its own config.
+type udpMux struct {
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	conns   map[string]*udpConn
+	accepts chan *udpConn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func listenUDP(network string, addr *net.UDPAddr) (*udpMux, error) {
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &udpMux{
+		conn:    conn,
+		conns:   make(map[string]*udpConn),
+		accepts: make(chan *udpConn, udpAcceptMax),
+		closed:  make(chan struct{}),
+	}
+	go m.read()
+	return m, nil
+}
+
+func (m *udpMux) read() {
+	defer m.Close()
+	buf := make([]byte, math.MaxUint16)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		m.mutex.Lock()
+		conn, ok := m.conns[addr.String()]
+		if !ok {
+			conn = &udpConn{mux: m, addr: addr, reads: make(chan []byte, udpQueueSize), closed: make(chan struct{}), deadlineSet: make(chan struct{})}
+			select {
+			case m.accepts <- conn:
+				m.conns[addr.String()] = conn
+			default:
+				m.mutex.Unlock()
+				continue
+			}
+		}
+		m.mutex.Unlock()
+		select {
+		case conn.reads <- data:
+		default:
+		}
+	}
+}
+
+// Accept returns the connection of the next new remote address.
+func (m *udpMux) Accept() (*udpConn, error) {
+	select {
+	case conn := <-m.accepts:
+		return conn, nil
+	case <-m.closed:
+		return nil, ErrUDPClosed
+	}
+}
+
+// Close closes the socket and every connection of it.
+func (m *udpMux) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.closed)
+		err = m.conn.Close()
+		m.mutex.Lock()
+		conns := make([]*udpConn, 0, len(m.conns))
+		for _, conn := range m.conns {
+			conns = append(conns, conn)
+		}
+		m.mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return err
+}
+
+func (m *udpMux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+func (m *udpMux) remove(conn *udpConn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conns[conn.addr.String()] == conn {
+		delete(m.conns, conn.addr.String())
+	}
+}
+
+// udpConn is the net.Conn of one remote address of udpMux, one Read returns one datagram.
+type udpConn struct {
+	mux         *udpMux
+	addr        *net.UDPAddr
+	reads       chan []byte
+	closed      chan struct{}
+	once        sync.Once
+	mutex       sync.Mutex
+	deadline    time.Time
+	deadlineSet chan struct{}
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		n, reset, err := c.read(p)
+		if !reset {
+			return n, err
+		}
+	}
+}
+
+// read waits one datagram until the read deadline, reset reports that the deadline changed while waiting.
+func (c *udpConn) read(p []byte) (int, bool, error) {
+	c.mutex.Lock()
+	deadline, deadlineSet := c.deadline, c.deadlineSet
+	c.mutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case data := <-c.reads:
+		return copy(p, data), false, nil
+	case <-c.closed:
+		return 0, false, ErrUDPClosed
+	case <-timeout:
+		return 0, false, udpTimeout{}
+	case <-deadlineSet:
+		return 0, true, nil
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrUDPClosed
+	default:
+	}
+	return c.mux.conn.WriteToUDP(p, c.addr)
+}
+
+func (c *udpConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.mux.remove(c)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.mux.Addr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline also applies to a blocked Read.
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, datagram writes do not block.
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
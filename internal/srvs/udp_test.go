@@ -0,0 +1,78 @@
+/* Copyright (c) 2018 FurtherSystem Co.,Ltd. All rights reserved.
+
+   This program is free software; you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation; version 2 of the License.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program; if not, write to the Free Software
+   Foundation, Inc., 51 Franklin St, Fifth Floor, Boston, MA 02110-1335  USA */
+
+package srvs
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPMux(t *testing.T) {
+	mux, err := listenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+
+	clients := []*net.UDPConn{}
+	for i := 0; i < 2; i++ {
+		client, err := net.DialUDP("udp4", nil, mux.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	buf := make([]byte, 16)
+	for i, client := range clients {
+		_, err = client.Write([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := mux.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() != client.LocalAddr().String() {
+			t.Errorf("accepted %s, want %s", conn.RemoteAddr(), client.LocalAddr())
+		}
+		n, err := conn.Read(buf)
+		if err != nil || n != 1 || buf[0] != byte(i) {
+			t.Errorf("read %v %v", buf[:n], err)
+		}
+		_, err = conn.Write([]byte("reply"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err = client.Read(buf)
+		if err != nil || string(buf[:n]) != "reply" {
+			t.Errorf("client read %q %v", buf[:n], err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err = conn.Read(buf)
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("read past deadline %v", err)
+		}
+	}
+
+	mux.Close()
+	_, err = mux.Accept()
+	if err != ErrUDPClosed {
+		t.Errorf("accept after close %v", err)
+	}
+}